@@ -0,0 +1,77 @@
+package app
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/me0888/twitter/pkg/models"
+)
+
+// Access says whether a route needs an authenticated caller.
+type Access int
+
+const (
+	// Required rejects requests without a valid token with 401.
+	Required Access = iota
+	// Optional resolves the token when one is sent, but lets anonymous
+	// requests through. An invalid token is still rejected.
+	Optional
+	// Public never looks at the token.
+	Public
+)
+
+const principalKey contextKey = "principal"
+
+// handle registers handler for path with the given access level, which the
+// authenticate middleware enforces.
+func (s *Server) handle(path string, handler http.HandlerFunc, access Access) *mux.Route {
+	route := s.mux.HandleFunc(path, handler)
+	s.access[route] = access
+	return route
+}
+
+// authenticate resolves the Authorization token once per request and puts the
+// principal into the request context. Routes not registered through handle
+// require authentication.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		access := Required
+		if route := mux.CurrentRoute(request); route != nil {
+			if level, ok := s.access[route]; ok {
+				access = level
+			}
+		}
+
+		token := request.Header.Get("Authorization")
+		if access == Public || access == Optional && token == "" {
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		principal, err := s.usersSvc.Authenticate(request.Context(), token)
+		if err != nil {
+			writeError(writer, request, err)
+			return
+		}
+
+		if info := requestInfoFrom(request); info != nil && principal.Locale != "" {
+			info.Lang = principal.Locale
+		}
+
+		next.ServeHTTP(writer, request.WithContext(context.WithValue(request.Context(), principalKey, principal)))
+	})
+}
+
+// principal returns the caller of request and whether it is authenticated.
+func principal(request *http.Request) (models.Principal, bool) {
+	principal, ok := request.Context().Value(principalKey).(models.Principal)
+	return principal, ok
+}
+
+// userID returns the ID of the authenticated caller, or 0 for an anonymous
+// request.
+func userID(request *http.Request) int64 {
+	principal, _ := principal(request)
+	return principal.UserID
+}
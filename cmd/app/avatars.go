@@ -4,39 +4,66 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/me0888/twitter/pkg/apperr"
+)
+
+// Avatar storage used unless SetAvatarStorage says otherwise.
+const (
+	DefaultAvatarsDir    = "avatars"
+	DefaultMaxUploadSize = 5 << 20
 )
 
+// SetAvatarStorage sets the directory uploaded avatars are written to and the
+// largest upload accepted, in bytes.
+func (s *Server) SetAvatarStorage(dir string, maxUploadSize int64) {
+	s.avatarsDir = dir
+	s.maxUploadSize = maxUploadSize
+}
+
 func (s *Server) handleUploadAvatar(writer http.ResponseWriter, request *http.Request) {
-	id := s.Auth(writer, request)
-	if id == 0 {
+	id := userID(request)
+
+	if !s.Verified(writer, request, id, ActionAvatar) {
 		return
 	}
 
+	if request.ContentLength > s.maxUploadSize {
+		writeError(writer, request, apperr.ErrTooLarge)
+		return
+	}
+	request.Body = http.MaxBytesReader(writer, request.Body, s.maxUploadSize)
+
 	file, handler, err := request.FormFile("avatar")
+	if err != nil && strings.Contains(err.Error(), "request body too large") {
+		writeError(writer, request, apperr.ErrTooLarge)
+		return
+	}
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, apperr.ErrBadRequest)
 		return
 	}
 
-	extension := strings.Split(handler.Filename, ".")[1]
-	file_route := "avatars/" + strconv.FormatInt(id, 10) + "." + extension
+	file_route := filepath.Join(s.avatarsDir, strconv.FormatInt(id, 10)+filepath.Ext(handler.Filename))
 
 	f, err := os.OpenFile(file_route, os.O_WRONLY|os.O_CREATE, 0666)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
 	_, err = io.Copy(f, file)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
 
 	avatar, err := s.usersSvc.UpdateAvatar(request.Context(), file_route, id)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
 	writeJSON(writer, avatar, http.StatusOK)
@@ -44,26 +71,50 @@ func (s *Server) handleUploadAvatar(writer http.ResponseWriter, request *http.Re
 }
 
 func (s *Server) handleGetAvatar(writer http.ResponseWriter, request *http.Request) {
-	id := s.Auth(writer, request)
-	if id == 0 {
+	id := userID(request)
+
+	avatar, err := s.usersSvc.GetAvatar(request.Context(), id)
+	if err != nil {
+		writeError(writer, request, err)
 		return
 	}
 
-	avatar, err := s.usersSvc.GetAvatar(request.Context(), id)
+	serveAvatar(writer, request, avatar)
+}
+
+// handleGetUserAvatar serves the avatar of another user, the avatar_url of
+// authors in tweets and comments.
+func (s *Server) handleGetUserAvatar(writer http.ResponseWriter, request *http.Request) {
+	username, ok := mux.Vars(request)["username"]
+	if !ok {
+		writeError(writer, request, apperr.ErrBadRequest)
+		return
+	}
+
+	avatar, err := s.usersSvc.UserAvatar(request.Context(), username)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
+	if avatar == "" {
+		writeError(writer, request, apperr.ErrNotFound)
+		return
+	}
+
+	serveAvatar(writer, request, avatar)
+}
 
+func serveAvatar(writer http.ResponseWriter, request *http.Request, avatar string) {
 	OpenFile, err := os.Open(avatar)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
+	defer OpenFile.Close()
+
 	_, err = io.Copy(writer, OpenFile)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
-
 }
@@ -4,27 +4,25 @@ import (
 	"encoding/json"
 	"net/http"
 	"strconv"
-	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/me0888/twitter/pkg/apperr"
 	"github.com/me0888/twitter/pkg/models"
+	"github.com/me0888/twitter/pkg/pagination"
+	"github.com/me0888/twitter/pkg/posts"
 )
 
 func (s *Server) handleGetCommentByID(writer http.ResponseWriter, request *http.Request) {
-	id := s.Auth(writer, request)
-	if id == 0 {
-		return
-	}
 	commentId, ok := mux.Vars(request)["comment_id"]
 	if !ok {
-		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		writeError(writer, request, apperr.ErrBadRequest)
 		return
 	}
 
-	resp, err := s.commentsSvc.GetComment(request.Context(), commentId)
+	resp, err := s.commentsSvc.GetComment(request.Context(), userID(request), commentId)
 
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
 
@@ -33,51 +31,52 @@ func (s *Server) handleGetCommentByID(writer http.ResponseWriter, request *http.
 }
 
 func (s *Server) handleUpdateComment(writer http.ResponseWriter, request *http.Request) {
-	id := s.Auth(writer, request)
-	if id == 0 {
-		return
-	}
+	id := userID(request)
 
 	var updateCommentInput models.Comment
 	if err := json.NewDecoder(request.Body).Decode(&updateCommentInput); err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
 
-	comment, err := s.commentsSvc.GetComment(request.Context(), strconv.FormatInt(updateCommentInput.ID, 10))
+	comment, err := s.commentsSvc.UpdateComment(request.Context(), id, updateCommentInput)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
 
-	comment.Content = updateCommentInput.Content
-	comment.UpdatedAt = time.Now()
+	writeJSON(writer, comment, http.StatusOK)
 
-	_, err = s.commentsSvc.UpdateComment(request.Context(), id, comment)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+}
+
+func (s *Server) handleGetCommentHistory(writer http.ResponseWriter, request *http.Request) {
+	commentId, ok := mux.Vars(request)["comment_id"]
+	if !ok {
+		writeError(writer, request, apperr.ErrBadRequest)
 		return
 	}
 
-	writeJSON(writer, comment, http.StatusOK)
+	resp, err := s.commentsSvc.GetCommentHistory(request.Context(), userID(request), commentId)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
 
+	writeJSON(writer, resp, http.StatusOK)
 }
 
 func (s *Server) handleDeleteComment(writer http.ResponseWriter, request *http.Request) {
-	id := s.Auth(writer, request)
-	if id == 0 {
-		return
-	}
+	id := userID(request)
 
 	commentId, ok := mux.Vars(request)["comment_id"]
 	if !ok {
-		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		writeError(writer, request, apperr.ErrBadRequest)
 		return
 	}
 
 	comment, err := s.commentsSvc.DeleteComment(request.Context(), id, commentId)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
 
@@ -85,21 +84,47 @@ func (s *Server) handleDeleteComment(writer http.ResponseWriter, request *http.R
 
 }
 
+func (s *Server) handleRestoreComment(writer http.ResponseWriter, request *http.Request) {
+	id := userID(request)
+
+	commentId, ok := mux.Vars(request)["comment_id"]
+	if !ok {
+		writeError(writer, request, apperr.ErrBadRequest)
+		return
+	}
+
+	comment, err := s.commentsSvc.RestoreComment(request.Context(), id, commentId)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+
+	writeJSON(writer, comment, http.StatusOK)
+}
+
 func (s *Server) handleLikeComment(writer http.ResponseWriter, request *http.Request) {
-	id := s.Auth(writer, request)
-	if id == 0 {
+	id := userID(request)
+
+	if !s.Verified(writer, request, id, ActionLike) {
 		return
 	}
+
 	commentId, ok := mux.Vars(request)["comment_id"]
 	if !ok {
-		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		writeError(writer, request, apperr.ErrBadRequest)
 		return
 	}
 
-	resp, err := s.commentsSvc.CommentLike(request.Context(), id, commentId)
+	var resp models.LikeResponse
+	var err error
+	if liked, ok := explicitState(request); ok {
+		resp, err = s.commentsSvc.SetCommentLike(request.Context(), id, commentId, liked)
+	} else {
+		resp, err = s.commentsSvc.CommentLike(request.Context(), id, commentId)
+	}
 
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
 
@@ -108,21 +133,22 @@ func (s *Server) handleLikeComment(writer http.ResponseWriter, request *http.Req
 }
 
 func (s *Server) handleGetCommentsLikedUsers(writer http.ResponseWriter, request *http.Request) {
-	id := s.Auth(writer, request)
-	if id == 0 {
+	commentId, ok := mux.Vars(request)["comment_id"]
+	if !ok {
+		writeError(writer, request, apperr.ErrBadRequest)
 		return
 	}
 
-	commentId, ok := mux.Vars(request)["comment_id"]
-	if !ok {
-		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	page, err := pagination.Parse(request.URL.Query())
+	if err != nil {
+		writeError(writer, request, err)
 		return
 	}
 
-	resp, err := s.commentsSvc.GetCommetsLikedUsers(request.Context(), commentId)
+	resp, err := s.commentsSvc.GetCommetsLikedUsers(request.Context(), commentId, page)
 
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
 
@@ -131,27 +157,28 @@ func (s *Server) handleGetCommentsLikedUsers(writer http.ResponseWriter, request
 }
 
 func (s *Server) handleCreateComment(writer http.ResponseWriter, request *http.Request) {
-	id := s.Auth(writer, request)
-	if id == 0 {
+	id := userID(request)
+
+	if !s.Verified(writer, request, id, ActionComment) {
 		return
 	}
 
 	var in models.CreateCommentInput
 	if err := json.NewDecoder(request.Body).Decode(&in); err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
 
 	tweetId, ok := mux.Vars(request)["tweet_id"]
 	if !ok {
-		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		writeError(writer, request, apperr.ErrBadRequest)
 		return
 	}
 
-	resp, err := s.commentsSvc.CreateComment(request.Context(), id, tweetId, in.Content)
+	resp, err := s.commentsSvc.CreateComment(request.Context(), id, tweetId, in.Content, in.ParentID)
 
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
 
@@ -160,23 +187,57 @@ func (s *Server) handleCreateComment(writer http.ResponseWriter, request *http.R
 }
 
 func (s *Server) handleGetTweetComments(writer http.ResponseWriter, request *http.Request) {
-	id := s.Auth(writer, request)
-	if id == 0 {
-		return
-	}
 	tweetId, ok := mux.Vars(request)["tweet_id"]
 	if !ok {
-		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		writeError(writer, request, apperr.ErrBadRequest)
+		return
+	}
+
+	page, err := pagination.Parse(request.URL.Query())
+	if err != nil {
+		writeError(writer, request, err)
 		return
 	}
 
-	resp, err := s.commentsSvc.GetComments(request.Context(), tweetId)
+	resp, err := s.commentsSvc.GetComments(request.Context(), userID(request), tweetId, request.URL.Query().Get("sort"), page)
 
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
 
 	writeJSON(writer, resp, http.StatusOK)
 
 }
+
+func (s *Server) handleGetCommentReplies(writer http.ResponseWriter, request *http.Request) {
+	commentId, ok := mux.Vars(request)["comment_id"]
+	if !ok {
+		writeError(writer, request, apperr.ErrBadRequest)
+		return
+	}
+
+	depth := posts.DefaultReplyDepth
+	if value := request.URL.Query().Get("depth"); value != "" {
+		var err error
+		depth, err = strconv.Atoi(value)
+		if err != nil || depth < 1 || depth > posts.MaxReplyDepth {
+			writeError(writer, request, apperr.FieldErrors{"depth": "invalid_depth"})
+			return
+		}
+	}
+
+	page, err := pagination.Parse(request.URL.Query())
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+
+	resp, err := s.commentsSvc.GetReplies(request.Context(), userID(request), commentId, request.URL.Query().Get("sort"), depth, page)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+
+	writeJSON(writer, resp, http.StatusOK)
+}
@@ -0,0 +1,38 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/me0888/twitter/pkg/config"
+	"github.com/me0888/twitter/pkg/counters"
+)
+
+// Reconcile recounts the denormalised counters once and reports every
+// discrepancy to w. With dryRun nothing is written.
+func Reconcile(cfg *config.Config, dryRun bool, w io.Writer) error {
+	pool, err := connect(cfg.Database)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	countersSvc := counters.NewService(pool)
+	countersSvc.SetBatchSize(cfg.Counters.BatchSize)
+
+	report, err := countersSvc.Reconcile(context.Background(), !dryRun)
+	for _, d := range report.Discrepancies {
+		fmt.Fprintln(w, d)
+	}
+	if err != nil {
+		return err
+	}
+
+	action := "fixed"
+	if dryRun {
+		action = "found"
+	}
+	fmt.Fprintf(w, "checked %d rows, %s %d discrepancies\n", report.Checked, action, len(report.Discrepancies))
+	return nil
+}
@@ -0,0 +1,99 @@
+package app
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+
+	"github.com/me0888/twitter/pkg/apperr"
+	"github.com/me0888/twitter/pkg/i18n"
+)
+
+type contextKey string
+
+const requestInfoKey contextKey = "request_info"
+
+// requestInfo is stored in the request context by ServeHTTP. Lang starts as
+// the language negotiated from Accept-Language and is replaced by the user's
+// preference once the request is authorised.
+type requestInfo struct {
+	ID   string
+	Lang string
+}
+
+// RequestIDHeader carries the request ID in both directions: a well-formed
+// ID sent by the client is kept, otherwise a new one is generated.
+const RequestIDHeader = "X-Request-ID"
+
+// writeError reports err as an apperr.Response tagged with the request ID.
+// Errors apperr does not recognise are logged and answered with a generic
+// internal error, so that driver messages never reach the client. The
+// message and field reasons are translated to the request language.
+func writeError(writer http.ResponseWriter, request *http.Request, err error) {
+	appErr := apperr.From(err)
+	lang := language(request)
+	body := apperr.Body{Code: appErr.Code, Message: appErr.Message, RequestID: requestID(request)}
+	if message, ok := i18n.Lookup(lang, appErr.Code); ok {
+		body.Message = message
+	}
+
+	var fields apperr.FieldErrors
+	if errors.As(err, &fields) {
+		body.Fields = make(apperr.FieldErrors, len(fields))
+		for name, reason := range fields {
+			body.Fields[name] = i18n.T(lang, "field."+reason)
+		}
+	}
+
+	if appErr.Status >= http.StatusInternalServerError {
+		errorf("request %s: %v", body.RequestID, err)
+	} else {
+		debugf("request %s: %s %s: %v", body.RequestID, request.Method, request.URL.Path, err)
+	}
+
+	writer.Header().Set("Content-Language", lang)
+	writeJSON(writer, apperr.Response{Error: body}, appErr.Status)
+}
+
+func requestInfoFrom(request *http.Request) *requestInfo {
+	info, _ := request.Context().Value(requestInfoKey).(*requestInfo)
+	return info
+}
+
+func requestID(request *http.Request) string {
+	if info := requestInfoFrom(request); info != nil {
+		return info.ID
+	}
+	return ""
+}
+
+// language returns the language texts for request should be written in.
+func language(request *http.Request) string {
+	if info := requestInfoFrom(request); info != nil {
+		return info.Lang
+	}
+	return i18n.Default
+}
+
+func newRequestID(request *http.Request) string {
+	id := request.Header.Get(RequestIDHeader)
+	if id != "" && len(id) <= 64 && validRequestID(id) {
+		return id
+	}
+
+	buffer := make([]byte, 8)
+	if _, err := rand.Read(buffer); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(buffer)
+}
+
+func validRequestID(id string) bool {
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
@@ -2,18 +2,23 @@ package app
 
 import (
 	"net/http"
+
+	"github.com/me0888/twitter/pkg/pagination"
 )
 
 func (s *Server) handleReadTweets(writer http.ResponseWriter, request *http.Request) {
-	id := s.Auth(writer, request)
-	if id == 0 {
+	id := userID(request)
+
+	page, err := pagination.Parse(request.URL.Query())
+	if err != nil {
+		writeError(writer, request, err)
 		return
 	}
 
-	resp, err := s.postsSvc.ReadTweets(request.Context(), id)
+	resp, err := s.postsSvc.ReadTweets(request.Context(), id, page)
 
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
 
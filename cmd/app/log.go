@@ -0,0 +1,34 @@
+package app
+
+import "log"
+
+// Log levels of the HTTP layer: debug also logs client errors, error logs
+// only failures.
+const (
+	LogDebug = "debug"
+	LogInfo  = "info"
+	LogError = "error"
+)
+
+var logLevel = LogInfo
+
+// SetLogLevel sets the level used by debugf, infof and errorf.
+func SetLogLevel(level string) {
+	logLevel = level
+}
+
+func debugf(format string, args ...interface{}) {
+	if logLevel == LogDebug {
+		log.Printf(format, args...)
+	}
+}
+
+func infof(format string, args ...interface{}) {
+	if logLevel != LogError {
+		log.Printf(format, args...)
+	}
+}
+
+func errorf(format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
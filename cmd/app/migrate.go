@@ -0,0 +1,80 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/me0888/twitter/database"
+	"github.com/me0888/twitter/pkg/config"
+	"github.com/me0888/twitter/pkg/migrate"
+)
+
+// Migrate runs a migrate subcommand, "up", "down" or "status", against the
+// configured database and reports the outcome to w. Down reverts steps
+// migrations.
+func Migrate(cfg *config.Config, command string, steps int, w io.Writer) error {
+	if command != "up" && command != "down" && command != "status" {
+		return fmt.Errorf("unknown migrate command %q", command)
+	}
+
+	pool, err := connect(cfg.Database)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	migrator, err := migrate.New(pool, database.Migrations)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	switch command {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		for _, migration := range applied {
+			fmt.Fprintf(w, "applied  %04d_%s\n", migration.Version, migration.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Fprintln(w, "schema is up to date")
+		}
+		return err
+	case "down":
+		reverted, err := migrator.Down(ctx, steps)
+		for _, migration := range reverted {
+			fmt.Fprintf(w, "reverted %04d_%s\n", migration.Version, migration.Name)
+		}
+		return err
+	default:
+		ss, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, status := range ss {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = status.AppliedAt.Format("2006-01-02 15:04:05 MST")
+			}
+			fmt.Fprintf(w, "%04d_%-30s %s\n", status.Version, status.Name, applied)
+		}
+	}
+	return nil
+}
+
+// checkSchema refuses to serve a database that misses migrations this build
+// relies on.
+func checkSchema(pool *pgxpool.Pool) error {
+	migrator, err := migrate.New(pool, database.Migrations)
+	if err != nil {
+		return err
+	}
+
+	err = migrator.Check(context.Background())
+	if errors.Is(err, migrate.ErrSchemaBehind) {
+		return fmt.Errorf("%v, this build needs version %d: run \"twitter migrate up\"", err, migrator.Latest())
+	}
+	return err
+}
@@ -4,28 +4,31 @@ import (
 	"encoding/json"
 	"net/http"
 	"strconv"
-	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/me0888/twitter/pkg/apperr"
 	"github.com/me0888/twitter/pkg/models"
+	"github.com/me0888/twitter/pkg/pagination"
+	"github.com/me0888/twitter/pkg/posts"
 )
 
 func (s *Server) handleCreateTweet(writer http.ResponseWriter, request *http.Request) {
 	var createPostInput models.CreatePostInput
 
 	if err := json.NewDecoder(request.Body).Decode(&createPostInput); err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
 
-	id := s.Auth(writer, request)
-	if id == 0 {
+	id := userID(request)
+
+	if !s.Verified(writer, request, id, ActionPost) {
 		return
 	}
 
-	resp, err := s.postsSvc.CreateTweet(request.Context(), id, createPostInput.Content)
+	resp, err := s.postsSvc.CreateTweet(request.Context(), id, createPostInput)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
 
@@ -34,51 +37,88 @@ func (s *Server) handleCreateTweet(writer http.ResponseWriter, request *http.Req
 }
 
 func (s *Server) handleGetTweetByID(writer http.ResponseWriter, request *http.Request) {
-	id := s.Auth(writer, request)
-	if id == 0 {
+	tweetId, ok := mux.Vars(request)["tweet_id"]
+	if !ok {
+		writeError(writer, request, apperr.ErrBadRequest)
+		return
+	}
+
+	resp, err := s.postsSvc.GetTweet(request.Context(), userID(request), tweetId)
+	if err != nil {
+		writeError(writer, request, err)
 		return
 	}
 
+	writeJSON(writer, resp, http.StatusOK)
+
+}
+
+func (s *Server) handleGetConversation(writer http.ResponseWriter, request *http.Request) {
 	tweetId, ok := mux.Vars(request)["tweet_id"]
 	if !ok {
-		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		writeError(writer, request, apperr.ErrBadRequest)
 		return
 	}
 
-	resp, err := s.postsSvc.GetTweet(request.Context(), tweetId)
+	depth := posts.DefaultReplyDepth
+	if value := request.URL.Query().Get("depth"); value != "" {
+		var err error
+		depth, err = strconv.Atoi(value)
+		if err != nil || depth < 1 || depth > posts.MaxReplyDepth {
+			writeError(writer, request, apperr.FieldErrors{"depth": "invalid_depth"})
+			return
+		}
+	}
+
+	page, err := pagination.Parse(request.URL.Query())
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
 
-	writeJSON(writer, resp, http.StatusOK)
+	resp, err := s.postsSvc.GetConversation(request.Context(), userID(request), tweetId, depth, page)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
 
+	writeJSON(writer, resp, http.StatusOK)
 }
 
-func (s *Server) handleUpdateTweet(writer http.ResponseWriter, request *http.Request) {
-	id := s.Auth(writer, request)
-	if id == 0 {
+func (s *Server) handleGetQuotes(writer http.ResponseWriter, request *http.Request) {
+	tweetId, ok := mux.Vars(request)["tweet_id"]
+	if !ok {
+		writeError(writer, request, apperr.ErrBadRequest)
 		return
 	}
 
-	var updatePostInput models.Tweet
-	if err := json.NewDecoder(request.Body).Decode(&updatePostInput); err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+	page, err := pagination.Parse(request.URL.Query())
+	if err != nil {
+		writeError(writer, request, err)
 		return
 	}
 
-	tweet, err := s.postsSvc.GetTweet(request.Context(), strconv.FormatInt(updatePostInput.ID, 10))
+	resp, err := s.postsSvc.GetQuotes(request.Context(), userID(request), tweetId, page)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
 
-	tweet.Content = updatePostInput.Content
-	tweet.UpdatedAt = time.Now()
+	writeJSON(writer, resp, http.StatusOK)
+}
+
+func (s *Server) handleUpdateTweet(writer http.ResponseWriter, request *http.Request) {
+	id := userID(request)
 
-	_, err = s.postsSvc.UpdateTweet(request.Context(), id, tweet)
+	var updatePostInput models.Tweet
+	if err := json.NewDecoder(request.Body).Decode(&updatePostInput); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+
+	tweet, err := s.postsSvc.UpdateTweet(request.Context(), id, updatePostInput)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
 
@@ -86,21 +126,34 @@ func (s *Server) handleUpdateTweet(writer http.ResponseWriter, request *http.Req
 
 }
 
-func (s *Server) handleDeleteTweet(writer http.ResponseWriter, request *http.Request) {
-	id := s.Auth(writer, request)
-	if id == 0 {
+func (s *Server) handleGetTweetHistory(writer http.ResponseWriter, request *http.Request) {
+	tweetId, ok := mux.Vars(request)["tweet_id"]
+	if !ok {
+		writeError(writer, request, apperr.ErrBadRequest)
 		return
 	}
 
+	resp, err := s.postsSvc.GetTweetHistory(request.Context(), userID(request), tweetId)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+
+	writeJSON(writer, resp, http.StatusOK)
+}
+
+func (s *Server) handleDeleteTweet(writer http.ResponseWriter, request *http.Request) {
+	id := userID(request)
+
 	tweetId, ok := mux.Vars(request)["tweet_id"]
 	if !ok {
-		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		writeError(writer, request, apperr.ErrBadRequest)
 		return
 	}
 
 	tweet, err := s.postsSvc.DeleteTweet(request.Context(), id, tweetId)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
 
@@ -108,21 +161,46 @@ func (s *Server) handleDeleteTweet(writer http.ResponseWriter, request *http.Req
 
 }
 
+func (s *Server) handleRestoreTweet(writer http.ResponseWriter, request *http.Request) {
+	id := userID(request)
+
+	tweetId, ok := mux.Vars(request)["tweet_id"]
+	if !ok {
+		writeError(writer, request, apperr.ErrBadRequest)
+		return
+	}
+
+	tweet, err := s.postsSvc.RestoreTweet(request.Context(), id, tweetId)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+
+	writeJSON(writer, tweet, http.StatusOK)
+}
+
 func (s *Server) handleLikeTweet(writer http.ResponseWriter, request *http.Request) {
-	id := s.Auth(writer, request)
-	if id == 0 {
+	id := userID(request)
+
+	if !s.Verified(writer, request, id, ActionLike) {
 		return
 	}
 
 	tweetId, ok := mux.Vars(request)["tweet_id"]
 	if !ok {
-		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		writeError(writer, request, apperr.ErrBadRequest)
 		return
 	}
 
-	resp, err := s.postsSvc.TweetLike(request.Context(), id, tweetId)
+	var resp models.LikeResponse
+	var err error
+	if liked, ok := explicitState(request); ok {
+		resp, err = s.postsSvc.SetTweetLike(request.Context(), id, tweetId, liked)
+	} else {
+		resp, err = s.postsSvc.TweetLike(request.Context(), id, tweetId)
+	}
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
 
@@ -131,20 +209,27 @@ func (s *Server) handleLikeTweet(writer http.ResponseWriter, request *http.Reque
 }
 
 func (s *Server) handleRetweetTweet(writer http.ResponseWriter, request *http.Request) {
-	id := s.Auth(writer, request)
-	if id == 0 {
+	id := userID(request)
+
+	if !s.Verified(writer, request, id, ActionRetweet) {
 		return
 	}
 
 	tweetId, ok := mux.Vars(request)["tweet_id"]
 	if !ok {
-		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		writeError(writer, request, apperr.ErrBadRequest)
 		return
 	}
 
-	resp, err := s.postsSvc.TweetRetweet(request.Context(), id, tweetId)
+	var resp models.RetweetResponse
+	var err error
+	if retweeted, ok := explicitState(request); ok {
+		resp, err = s.postsSvc.SetTweetRetweet(request.Context(), id, tweetId, retweeted)
+	} else {
+		resp, err = s.postsSvc.TweetRetweet(request.Context(), id, tweetId)
+	}
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
 
@@ -153,20 +238,21 @@ func (s *Server) handleRetweetTweet(writer http.ResponseWriter, request *http.Re
 }
 
 func (s *Server) handleTweetLikedUsers(writer http.ResponseWriter, request *http.Request) {
-	id := s.Auth(writer, request)
-	if id == 0 {
+	tweetId, ok := mux.Vars(request)["tweet_id"]
+	if !ok {
+		writeError(writer, request, apperr.ErrBadRequest)
 		return
 	}
 
-	tweetId, ok := mux.Vars(request)["tweet_id"]
-	if !ok {
-		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	page, err := pagination.Parse(request.URL.Query())
+	if err != nil {
+		writeError(writer, request, err)
 		return
 	}
 
-	resp, err := s.postsSvc.TweetLikes(request.Context(), tweetId)
+	resp, err := s.postsSvc.TweetLikes(request.Context(), tweetId, page)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
 
@@ -175,20 +261,21 @@ func (s *Server) handleTweetLikedUsers(writer http.ResponseWriter, request *http
 }
 
 func (s *Server) handleTweetRetweetedUsers(writer http.ResponseWriter, request *http.Request) {
-	id := s.Auth(writer, request)
-	if id == 0 {
+	tweetId, ok := mux.Vars(request)["tweet_id"]
+	if !ok {
+		writeError(writer, request, apperr.ErrBadRequest)
 		return
 	}
 
-	tweetId, ok := mux.Vars(request)["tweet_id"]
-	if !ok {
-		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	page, err := pagination.Parse(request.URL.Query())
+	if err != nil {
+		writeError(writer, request, err)
 		return
 	}
 
-	resp, err := s.postsSvc.TweetRetweetedUsers(request.Context(), tweetId)
+	resp, err := s.postsSvc.TweetRetweetedUsers(request.Context(), tweetId, page)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
 
@@ -197,20 +284,21 @@ func (s *Server) handleTweetRetweetedUsers(writer http.ResponseWriter, request *
 }
 
 func (s *Server) handleGetTweets(writer http.ResponseWriter, request *http.Request) {
-	id := s.Auth(writer, request)
-	if id == 0 {
+	username, ok := mux.Vars(request)["username"]
+	if !ok {
+		writeError(writer, request, apperr.ErrBadRequest)
 		return
 	}
 
-	username, ok := mux.Vars(request)["username"]
-	if !ok {
-		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	page, err := pagination.Parse(request.URL.Query())
+	if err != nil {
+		writeError(writer, request, err)
 		return
 	}
 
-	resp, err := s.postsSvc.GetTweets(request.Context(), username)
+	resp, err := s.postsSvc.GetTweets(request.Context(), userID(request), username, page)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
 
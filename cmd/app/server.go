@@ -1,10 +1,13 @@
 package app
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/gorilla/mux"
+	"github.com/me0888/twitter/pkg/apperr"
 	"github.com/me0888/twitter/pkg/comments"
+	"github.com/me0888/twitter/pkg/i18n"
 	"github.com/me0888/twitter/pkg/posts"
 	"github.com/me0888/twitter/pkg/users"
 )
@@ -14,13 +17,27 @@ type Server struct {
 	usersSvc    *users.Service
 	postsSvc    *posts.Service
 	commentsSvc *comments.Service
+	restricted  map[string]bool
+	access      map[*mux.Route]Access
+
+	registration  bool
+	avatarsDir    string
+	maxUploadSize int64
 }
 
 func NewServer(mux *mux.Router, usersSvc *users.Service, postsSvc *posts.Service, commentsSvc *comments.Service) *Server {
-	return &Server{mux: mux, usersSvc: usersSvc, postsSvc: postsSvc, commentsSvc: commentsSvc}
+	server := &Server{mux: mux, usersSvc: usersSvc, postsSvc: postsSvc, commentsSvc: commentsSvc}
+	server.SetUnverifiedRestrictions(DefaultUnverifiedRestrictions)
+	server.SetRegistration(true)
+	server.SetAvatarStorage(DefaultAvatarsDir, DefaultMaxUploadSize)
+	return server
 }
 
 func (s *Server) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	info := &requestInfo{ID: newRequestID(request), Lang: i18n.Match(request.Header.Get("Accept-Language"))}
+	writer.Header().Set(RequestIDHeader, info.ID)
+	request = request.WithContext(context.WithValue(request.Context(), requestInfoKey, info))
+
 	s.mux.ServeHTTP(writer, request)
 }
 
@@ -28,41 +45,72 @@ const (
 	GET    = "GET"
 	POST   = "POST"
 	PUT    = "PUT"
+	PATCH  = "PATCH"
 	DELETE = "DELETE"
 )
 
 func (s *Server) Init() {
+	s.access = make(map[*mux.Route]Access)
+	s.mux.NotFoundHandler = http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writeError(writer, request, apperr.ErrNotFound)
+	})
+	s.mux.MethodNotAllowedHandler = http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writeError(writer, request, apperr.ErrMethod)
+	})
+	s.mux.Use(s.authenticate)
 
-	s.mux.HandleFunc("/users", s.handleCreateUser).Methods(POST)
-	s.mux.HandleFunc("/login", s.handleLogin).Methods(POST)
-	s.mux.HandleFunc("/user", s.handleGetUserByID).Methods(GET)
-	s.mux.HandleFunc("/user", s.handleUpdateUser).Methods(PUT)
-	s.mux.HandleFunc("/users", s.handleSearchUsers).Methods(GET)
-	s.mux.HandleFunc("/users/{username}/follow", s.handleFollow).Methods(POST)
-	s.mux.HandleFunc("/users/{username}/followers", s.handleFollowers).Methods(GET)
-	s.mux.HandleFunc("/users/{username}/followees", s.handleFollowees).Methods(GET)
-	s.mux.HandleFunc("/users/{username}/tweets", s.handleGetTweets).Methods(GET)
+	s.handle("/users", s.handleCreateUser, Optional).Methods(POST)
+	s.handle("/login", s.handleLogin, Public).Methods(POST)
+	s.handle("/login/2fa", s.handleLoginChallenge, Public).Methods(POST)
+	s.handle("/token/refresh", s.handleRefreshToken, Public).Methods(POST)
+	s.handle("/password/forgot", s.handleForgotPassword, Public).Methods(POST)
+	s.handle("/password/reset", s.handleResetPassword, Public).Methods(POST)
+	s.handle("/logout", s.handleLogout, Required).Methods(POST)
+	s.handle("/sessions", s.handleGetSessions, Required).Methods(GET)
+	s.handle("/sessions", s.handleRevokeSessions, Required).Methods(DELETE)
+	s.handle("/sessions/{session_id}", s.handleRevokeSession, Required).Methods(DELETE)
+	s.handle("/user", s.handleGetUserByID, Required).Methods(GET)
+	s.handle("/user", s.handleUpdateUser, Required).Methods(PUT)
+	s.handle("/user", s.handlePatchUser, Required).Methods(PATCH)
+	s.handle("/user/email/verification", s.handleSendVerification, Required).Methods(POST)
+	s.handle("/user/email/verify", s.handleVerifyEmail, Public).Methods(POST)
+	s.handle("/user/2fa", s.handleEnrollTOTP, Required).Methods(POST)
+	s.handle("/user/2fa/confirm", s.handleConfirmTOTP, Required).Methods(POST)
+	s.handle("/user/2fa", s.handleDisableTOTP, Required).Methods(DELETE)
+	s.handle("/users", s.handleSearchUsers, Required).Methods(GET)
+	s.handle("/users/{username}/follow", s.handleFollow, Required).Methods(POST, PUT, DELETE)
+	s.handle("/users/{username}/followers", s.handleFollowers, Required).Methods(GET)
+	s.handle("/users/{username}/followees", s.handleFollowees, Required).Methods(GET)
+	s.handle("/users/{username}/tweets", s.handleGetTweets, Required).Methods(GET)
+	s.handle("/users/{username}/avatar", s.handleGetUserAvatar, Required).Methods(GET)
 
-	s.mux.HandleFunc("/tweets", s.handleCreateTweet).Methods(POST)
-	s.mux.HandleFunc("/tweets", s.handleUpdateTweet).Methods(PUT)
-	s.mux.HandleFunc("/tweets/{tweet_id}", s.handleGetTweetByID).Methods(GET)
-	s.mux.HandleFunc("/tweets/{tweet_id}", s.handleDeleteTweet).Methods(DELETE)
-	s.mux.HandleFunc("/tweets/{tweet_id}/like", s.handleLikeTweet).Methods(POST)
-	s.mux.HandleFunc("/tweets/{tweet_id}/liked_users", s.handleTweetLikedUsers).Methods(GET)
-	s.mux.HandleFunc("/tweets/{tweet_id}/retweet", s.handleRetweetTweet).Methods(POST)
-	s.mux.HandleFunc("/tweets/{tweet_id}/retweeted_users", s.handleTweetRetweetedUsers).Methods(GET)
-	s.mux.HandleFunc("/tweets/{tweet_id}/comments", s.handleCreateComment).Methods(POST)
-	s.mux.HandleFunc("/tweets/{tweet_id}/comments", s.handleGetTweetComments).Methods(GET)
+	s.handle("/tweets", s.handleCreateTweet, Required).Methods(POST)
+	s.handle("/tweets", s.handleUpdateTweet, Required).Methods(PUT)
+	s.handle("/tweets/{tweet_id}", s.handleGetTweetByID, Required).Methods(GET)
+	s.handle("/tweets/{tweet_id}", s.handleDeleteTweet, Required).Methods(DELETE)
+	s.handle("/tweets/{tweet_id}/conversation", s.handleGetConversation, Required).Methods(GET)
+	s.handle("/tweets/{tweet_id}/restore", s.handleRestoreTweet, Required).Methods(POST)
+	s.handle("/tweets/{tweet_id}/history", s.handleGetTweetHistory, Required).Methods(GET)
+	s.handle("/tweets/{tweet_id}/quotes", s.handleGetQuotes, Required).Methods(GET)
+	s.handle("/tweets/{tweet_id}/like", s.handleLikeTweet, Required).Methods(POST, PUT, DELETE)
+	s.handle("/tweets/{tweet_id}/liked_users", s.handleTweetLikedUsers, Required).Methods(GET)
+	s.handle("/tweets/{tweet_id}/retweet", s.handleRetweetTweet, Required).Methods(POST, PUT, DELETE)
+	s.handle("/tweets/{tweet_id}/retweeted_users", s.handleTweetRetweetedUsers, Required).Methods(GET)
+	s.handle("/tweets/{tweet_id}/comments", s.handleCreateComment, Required).Methods(POST)
+	s.handle("/tweets/{tweet_id}/comments", s.handleGetTweetComments, Required).Methods(GET)
 
-	s.mux.HandleFunc("/comments", s.handleUpdateComment).Methods(PUT)
-	s.mux.HandleFunc("/comments/{comment_id}", s.handleGetCommentByID).Methods(GET)
-	s.mux.HandleFunc("/comments/{comment_id}", s.handleDeleteComment).Methods(DELETE)
-	s.mux.HandleFunc("/comments/{comment_id}/like", s.handleLikeComment).Methods(POST)
-	s.mux.HandleFunc("/comments/{comment_id}/liked_users", s.handleGetCommentsLikedUsers).Methods(GET)
+	s.handle("/comments", s.handleUpdateComment, Required).Methods(PUT)
+	s.handle("/comments/{comment_id}", s.handleGetCommentByID, Required).Methods(GET)
+	s.handle("/comments/{comment_id}", s.handleDeleteComment, Required).Methods(DELETE)
+	s.handle("/comments/{comment_id}/restore", s.handleRestoreComment, Required).Methods(POST)
+	s.handle("/comments/{comment_id}/history", s.handleGetCommentHistory, Required).Methods(GET)
+	s.handle("/comments/{comment_id}/replies", s.handleGetCommentReplies, Required).Methods(GET)
+	s.handle("/comments/{comment_id}/like", s.handleLikeComment, Required).Methods(POST, PUT, DELETE)
+	s.handle("/comments/{comment_id}/liked_users", s.handleGetCommentsLikedUsers, Required).Methods(GET)
 
-	s.mux.HandleFunc("/avatar", s.handleUploadAvatar).Methods(POST)
-	s.mux.HandleFunc("/avatar", s.handleGetAvatar).Methods(GET)
+	s.handle("/avatar", s.handleUploadAvatar, Required).Methods(POST)
+	s.handle("/avatar", s.handleGetAvatar, Required).Methods(GET)
 
-	s.mux.HandleFunc("/feed", s.handleReadTweets).Methods(GET)
+	s.handle("/feed", s.handleReadTweets, Required).Methods(GET)
 
 }
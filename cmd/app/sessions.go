@@ -0,0 +1,87 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/me0888/twitter/pkg/apperr"
+	"github.com/me0888/twitter/pkg/models"
+)
+
+func (s *Server) handleRefreshToken(writer http.ResponseWriter, request *http.Request) {
+	var refreshInput models.RefreshInput
+
+	if err := json.NewDecoder(request.Body).Decode(&refreshInput); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+
+	resp, err := s.usersSvc.Refresh(request.Context(), refreshInput.RefreshToken, request.UserAgent())
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+
+	writeJSON(writer, resp, http.StatusOK)
+
+}
+
+func (s *Server) handleLogout(writer http.ResponseWriter, request *http.Request) {
+	principal, _ := principal(request)
+
+	err := s.usersSvc.Logout(request.Context(), principal.SessionID)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+
+	writeJSON(writer, models.RevokeResponse{Revoked: 1}, http.StatusOK)
+
+}
+
+func (s *Server) handleGetSessions(writer http.ResponseWriter, request *http.Request) {
+	principal, _ := principal(request)
+
+	resp, err := s.usersSvc.Sessions(request.Context(), principal.UserID, principal.SessionID)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+
+	writeJSON(writer, resp, http.StatusOK)
+
+}
+
+func (s *Server) handleRevokeSession(writer http.ResponseWriter, request *http.Request) {
+	id := userID(request)
+
+	sessionId, err := strconv.ParseInt(mux.Vars(request)["session_id"], 10, 64)
+	if err != nil {
+		writeError(writer, request, apperr.FieldErrors{"id": "invalid_id"})
+		return
+	}
+
+	err = s.usersSvc.RevokeSession(request.Context(), id, sessionId)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+
+	writeJSON(writer, models.RevokeResponse{Revoked: 1}, http.StatusOK)
+
+}
+
+func (s *Server) handleRevokeSessions(writer http.ResponseWriter, request *http.Request) {
+	id := userID(request)
+
+	revoked, err := s.usersSvc.RevokeSessions(request.Context(), id)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+
+	writeJSON(writer, models.RevokeResponse{Revoked: revoked}, http.StatusOK)
+
+}
@@ -0,0 +1,77 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/me0888/twitter/pkg/models"
+)
+
+func (s *Server) handleEnrollTOTP(writer http.ResponseWriter, request *http.Request) {
+	id := userID(request)
+
+	resp, err := s.usersSvc.EnrollTOTP(request.Context(), id)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+
+	writeJSON(writer, resp, http.StatusOK)
+
+}
+
+func (s *Server) handleConfirmTOTP(writer http.ResponseWriter, request *http.Request) {
+	id := userID(request)
+
+	var in models.TOTPCodeInput
+	if err := json.NewDecoder(request.Body).Decode(&in); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+
+	err := s.usersSvc.ConfirmTOTP(request.Context(), id, in.Code)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+
+	writeJSON(writer, map[string]bool{"enabled": true}, http.StatusOK)
+
+}
+
+func (s *Server) handleDisableTOTP(writer http.ResponseWriter, request *http.Request) {
+	id := userID(request)
+
+	var in models.TOTPCodeInput
+	if err := json.NewDecoder(request.Body).Decode(&in); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+
+	err := s.usersSvc.DisableTOTP(request.Context(), id, in.Code)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+
+	writeJSON(writer, map[string]bool{"enabled": false}, http.StatusOK)
+
+}
+
+func (s *Server) handleLoginChallenge(writer http.ResponseWriter, request *http.Request) {
+	var in models.LoginChallengeInput
+
+	if err := json.NewDecoder(request.Body).Decode(&in); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+
+	resp, err := s.usersSvc.LoginChallenge(request.Context(), in.Challenge, in.Code, request.UserAgent())
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+
+	writeJSON(writer, resp, http.StatusOK)
+
+}
@@ -2,68 +2,75 @@ package app
 
 import (
 	"encoding/json"
+	"io"
 	"net/http"
 
 	"github.com/gorilla/mux"
+	"github.com/me0888/twitter/pkg/apperr"
 	"github.com/me0888/twitter/pkg/models"
-
-	"golang.org/x/crypto/bcrypt"
+	"github.com/me0888/twitter/pkg/pagination"
 )
 
+// ErrRegistrationDisabled is returned by POST /users when the registration
+// feature is switched off.
+var ErrRegistrationDisabled = apperr.New(http.StatusForbidden, "registration_disabled", "registration is disabled")
+
+// SetRegistration switches POST /users on or off.
+func (s *Server) SetRegistration(enabled bool) {
+	s.registration = enabled
+}
+
 func (s *Server) handleCreateUser(writer http.ResponseWriter, request *http.Request) {
 	var user *models.UserInput
 
-	if err := json.NewDecoder(request.Body).Decode(&user); err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+	if !s.registration {
+		writeError(writer, request, ErrRegistrationDisabled)
 		return
 	}
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+	if err := json.NewDecoder(request.Body).Decode(&user); err != nil {
+		writeError(writer, request, err)
 		return
 	}
-	user.Password = string(hash)
 
 	item, err := s.usersSvc.Save(request.Context(), user)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
 
+	if err = s.usersSvc.SendVerification(request.Context(), item.ID, language(request)); err != nil {
+		errorf("request %s: %v", requestID(request), err)
+	}
+
 	writeJSON(writer, item, http.StatusOK)
 
 }
 
 func (s *Server) handleLogin(writer http.ResponseWriter, request *http.Request) {
 	var loginInput models.LoginInput
-	var loginOutput models.LoginOutput
 
 	if err := json.NewDecoder(request.Body).Decode(&loginInput); err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
 
-	token, err := s.usersSvc.Token(request.Context(), loginInput.Email, loginInput.Password)
+	loginOutput, err := s.usersSvc.Token(request.Context(), loginInput.Email, loginInput.Password, request.UserAgent())
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
-	loginOutput.Token = token
 
 	writeJSON(writer, loginOutput, http.StatusOK)
 
 }
 
 func (s *Server) handleGetUserByID(writer http.ResponseWriter, request *http.Request) {
-	id := s.Auth(writer, request)
-	if id == 0 {
-		return
-	}
+	id := userID(request)
 
 	resp, err := s.usersSvc.User(request.Context(), id)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
 
@@ -71,45 +78,41 @@ func (s *Server) handleGetUserByID(writer http.ResponseWriter, request *http.Req
 
 }
 
+// handleUpdateUser serves PUT /user. Fields sent as empty strings keep their
+// current value, as they always did for this endpoint.
 func (s *Server) handleUpdateUser(writer http.ResponseWriter, request *http.Request) {
-	var user *models.UserInput
+	id := userID(request)
 
-	id := s.Auth(writer, request)
-	if id == 0 {
+	patch, err := decodeUserPatch(request.Body, true)
+	if err != nil {
+		writeError(writer, request, err)
 		return
 	}
 
-	oldUser, err := s.usersSvc.User(request.Context(), id)
+	item, err := s.usersSvc.Update(request.Context(), id, patch)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
 
-	if err := json.NewDecoder(request.Body).Decode(&user); err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
-		return
-	}
+	writeJSON(writer, item, http.StatusOK)
 
-	if len(user.Password) > 0 {
-		hash, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
-		if err != nil {
-			http.Error(writer, err.Error(), http.StatusBadRequest)
-			return
-		}
-		user.Password = string(hash)
-	}
+}
 
-	if len(user.Email) == 0 {
-		user.Email = oldUser.Email
-	}
+// handlePatchUser serves PATCH /user with JSON merge patch semantics: only
+// the members present in the document are changed.
+func (s *Server) handlePatchUser(writer http.ResponseWriter, request *http.Request) {
+	id := userID(request)
 
-	if len(user.Password) == 0 {
-		user.Username = oldUser.UserName
+	patch, err := decodeUserPatch(request.Body, false)
+	if err != nil {
+		writeError(writer, request, err)
+		return
 	}
 
-	item, err := s.usersSvc.Update(request.Context(), user, id)
+	item, err := s.usersSvc.Update(request.Context(), id, patch)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
 
@@ -117,22 +120,75 @@ func (s *Server) handleUpdateUser(writer http.ResponseWriter, request *http.Requ
 
 }
 
+// decodeUserPatch reads a JSON merge patch (RFC 7396) of the user profile.
+// Members set to null are rejected, since none of the fields can be removed.
+func decodeUserPatch(body io.Reader, skipEmpty bool) (models.UserPatch, error) {
+	var patch models.UserPatch
+	var doc map[string]json.RawMessage
+
+	if err := json.NewDecoder(body).Decode(&doc); err != nil {
+		return patch, err
+	}
+
+	fields := map[string]**string{"email": &patch.Email, "username": &patch.Username, "password": &patch.Password, "locale": &patch.Locale}
+	errs := apperr.FieldErrors{}
+	for name, raw := range doc {
+		var value string
+
+		if string(raw) == "null" {
+			errs[name] = "cannot_be_removed"
+			continue
+		}
+		if err := json.Unmarshal(raw, &value); err != nil {
+			errs[name] = "must_be_string"
+			continue
+		}
+
+		if name == "current_password" {
+			patch.CurrentPassword = value
+			continue
+		}
+
+		field, ok := fields[name]
+		if !ok {
+			errs[name] = "unknown_field"
+			continue
+		}
+		if skipEmpty && value == "" {
+			continue
+		}
+		*field = &value
+	}
+
+	if len(errs) > 0 {
+		return patch, errs
+	}
+	return patch, nil
+}
+
 func (s *Server) handleFollow(writer http.ResponseWriter, request *http.Request) {
 
-	id := s.Auth(writer, request)
-	if id == 0 {
+	id := userID(request)
+
+	if !s.Verified(writer, request, id, ActionFollow) {
 		return
 	}
 
 	username, ok := mux.Vars(request)["username"]
 	if !ok {
-		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		writeError(writer, request, apperr.ErrBadRequest)
 		return
 	}
 
-	resp, err := s.usersSvc.Follow(request.Context(), id, username)
+	var resp models.FollowResponse
+	var err error
+	if following, ok := explicitState(request); ok {
+		resp, err = s.usersSvc.SetFollow(request.Context(), id, username, following)
+	} else {
+		resp, err = s.usersSvc.Follow(request.Context(), id, username)
+	}
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
 
@@ -141,16 +197,17 @@ func (s *Server) handleFollow(writer http.ResponseWriter, request *http.Request)
 }
 
 func (s *Server) handleSearchUsers(writer http.ResponseWriter, request *http.Request) {
-	id := s.Auth(writer, request)
-	if id == 0 {
+	username := request.URL.Query().Get("search")
+
+	page, err := pagination.Parse(request.URL.Query())
+	if err != nil {
+		writeError(writer, request, err)
 		return
 	}
 
-	username := request.URL.Query().Get("search")
-
-	resp, err := s.usersSvc.Users(request.Context(), username)
+	resp, err := s.usersSvc.Users(request.Context(), username, page)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
 
@@ -158,20 +215,21 @@ func (s *Server) handleSearchUsers(writer http.ResponseWriter, request *http.Req
 }
 
 func (s *Server) handleFollowers(writer http.ResponseWriter, request *http.Request) {
-	id := s.Auth(writer, request)
-	if id == 0 {
+	username, ok := mux.Vars(request)["username"]
+	if !ok {
+		writeError(writer, request, apperr.ErrBadRequest)
 		return
 	}
 
-	username, ok := mux.Vars(request)["username"]
-	if !ok {
-		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	page, err := pagination.Parse(request.URL.Query())
+	if err != nil {
+		writeError(writer, request, err)
 		return
 	}
 
-	resp, err := s.usersSvc.Followers(request.Context(), username)
+	resp, err := s.usersSvc.Followers(request.Context(), username, page)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
 
@@ -179,20 +237,21 @@ func (s *Server) handleFollowers(writer http.ResponseWriter, request *http.Reque
 }
 
 func (s *Server) handleFollowees(writer http.ResponseWriter, request *http.Request) {
-	id := s.Auth(writer, request)
-	if id == 0 {
+	username, ok := mux.Vars(request)["username"]
+	if !ok {
+		writeError(writer, request, apperr.ErrBadRequest)
 		return
 	}
 
-	username, ok := mux.Vars(request)["username"]
-	if !ok {
-		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	page, err := pagination.Parse(request.URL.Query())
+	if err != nil {
+		writeError(writer, request, err)
 		return
 	}
 
-	resp, err := s.usersSvc.Followees(request.Context(), username)
+	resp, err := s.usersSvc.Followees(request.Context(), username, page)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		writeError(writer, request, err)
 		return
 	}
 
@@ -2,16 +2,24 @@ package app
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/json"
-	"log"
+	"fmt"
 	"net"
 	"net/http"
-	"time"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
 	"github.com/gorilla/mux"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/me0888/twitter/pkg/comments"
+	"github.com/me0888/twitter/pkg/config"
+	"github.com/me0888/twitter/pkg/counters"
+	"github.com/me0888/twitter/pkg/mail"
 	"github.com/me0888/twitter/pkg/posts"
+	"github.com/me0888/twitter/pkg/timeline"
 	"github.com/me0888/twitter/pkg/users"
 )
 
@@ -30,40 +38,193 @@ func writeJSON(writer http.ResponseWriter, item interface{}, code int) {
 	}
 }
 
-func (s *Server) Auth(writer http.ResponseWriter, request *http.Request) (id int64) {
-	token := request.Header.Get("Authorization")
-	id, err := s.usersSvc.IDByToken(request.Context(), token)
-	if err != nil {
-		status := map[string]string{"status": "Не авторизован"}
-		writeJSON(writer, status, http.StatusUnauthorized)
-		return
+// explicitState tells the idempotent verbs of a toggle route apart from the
+// toggle itself: PUT sets the state, DELETE clears it and POST flips it.
+func explicitState(request *http.Request) (state bool, ok bool) {
+	switch request.Method {
+	case PUT:
+		return true, true
+	case DELETE:
+		return false, true
+	default:
+		return false, false
 	}
-	return id
 }
 
-func Execute(host string, port string, dns string) (err error) {
-	connCtx, cancel := context.WithTimeout(context.Background(), time.Second*15)
-	defer cancel()
+// Execute connects to the database, wires the services together as cfg
+// describes and serves HTTP until the server fails or SIGINT or SIGTERM
+// arrives. On a signal it stops accepting connections, lets in-flight
+// requests finish within cfg.Server.ShutdownTimeout, stops the background
+// workers and only then closes the pool. The error it returns is not logged;
+// the caller reports it.
+func Execute(cfg *config.Config) (err error) {
+	SetLogLevel(cfg.Log.Level)
 
-	pool, err := pgxpool.Connect(connCtx, dns)
+	pool, err := connect(cfg.Database)
 	if err != nil {
-		log.Println(err)
-		return
+		return err
 	}
 
 	defer pool.Close()
 
+	if err = checkSchema(pool); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	key := []byte(cfg.Auth.Secret)
+	if len(key) == 0 {
+		infof("auth.secret is not set, reset and verification tokens will not survive a restart")
+		key = make([]byte, 32)
+		if _, err = rand.Read(key); err != nil {
+			return err
+		}
+	}
+
 	mux := mux.NewRouter()
 	usersSvc := users.NewService(pool)
+	usersSvc.SetMailer(newMailer(cfg.Mail))
+	usersSvc.SetSecret(key)
+	usersSvc.SetTokenTTL(cfg.Auth.AccessTokenTTL, cfg.Auth.RefreshTokenTTL)
+
+	params := users.DefaultArgon2Params
+	params.Memory = cfg.Auth.Argon2Memory
+	params.Iterations = cfg.Auth.Argon2Iterations
+	params.Parallelism = cfg.Auth.Argon2Parallelism
+	usersSvc.SetPasswordHasher(users.NewArgon2Hasher(params))
+
+	validator := users.NewValidator()
+	if cfg.Auth.PasswordDenylist != "" {
+		if err = validator.LoadDenylist(cfg.Auth.PasswordDenylist); err != nil {
+			return err
+		}
+	}
+	usersSvc.SetValidator(validator)
+
+	timelineSvc := timeline.NewService(pool)
+	timelineSvc.SetSize(cfg.Timeline.Size)
+	timelineSvc.SetFanoutLimit(cfg.Timeline.FanoutLimit)
+	timelineSvc.SetQueueSize(cfg.Timeline.QueueSize)
+	usersSvc.SetTimeline(timelineSvc)
+
 	postsSvc := posts.NewService(pool)
+	postsSvc.SetTimeline(timelineSvc)
+	postsSvc.SetEditWindow(cfg.Edits.Window)
+	postsSvc.SetMaxEdits(cfg.Edits.MaxCount)
+	postsSvc.SetUndoWindow(cfg.Deletes.UndoWindow)
+	postsSvc.SetRetention(cfg.Deletes.Retention)
 	commentsSvc := comments.NewService(pool)
+	commentsSvc.SetMaxDepth(cfg.Comments.MaxDepth)
+	commentsSvc.SetEditWindow(cfg.Edits.Window)
+	commentsSvc.SetMaxEdits(cfg.Edits.MaxCount)
+	commentsSvc.SetUndoWindow(cfg.Deletes.UndoWindow)
+	commentsSvc.SetRetention(cfg.Deletes.Retention)
 	server := NewServer(mux, usersSvc, postsSvc, commentsSvc)
+	if err = server.SetUnverifiedRestrictions(cfg.Features.UnverifiedRestrictions); err != nil {
+		return err
+	}
+	server.SetRegistration(cfg.Features.Registration)
+	server.SetAvatarStorage(cfg.Avatars.Dir, cfg.Avatars.MaxUploadSize)
 	server.Init()
 
+	workersCtx, stopWorkers := context.WithCancel(context.Background())
+	var workers sync.WaitGroup
+	defer workers.Wait()
+	defer stopWorkers()
+
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		usersSvc.StartTokenSweeper(workersCtx, cfg.Auth.TokenSweepInterval)
+	}()
+
+	workers.Add(2)
+	go func() {
+		defer workers.Done()
+		timelineSvc.Start(workersCtx)
+	}()
+	go func() {
+		defer workers.Done()
+		timelineSvc.StartTrimmer(workersCtx, cfg.Timeline.TrimInterval)
+	}()
+
+	workers.Add(2)
+	go func() {
+		defer workers.Done()
+		postsSvc.StartPurger(workersCtx, cfg.Deletes.PurgeInterval)
+	}()
+	go func() {
+		defer workers.Done()
+		commentsSvc.StartPurger(workersCtx, cfg.Deletes.PurgeInterval)
+	}()
+
+	if cfg.Counters.ReconcileInterval > 0 {
+		countersSvc := counters.NewService(pool)
+		countersSvc.SetBatchSize(cfg.Counters.BatchSize)
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			countersSvc.StartReconciler(workersCtx, cfg.Counters.ReconcileInterval)
+		}()
+	}
+
 	srv := &http.Server{
-		Addr:    net.JoinHostPort(host, port),
-		Handler: server,
+		Addr:              net.JoinHostPort(cfg.Server.Host, cfg.Server.Port),
+		Handler:           server,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		infof("Server starts at port: %s", cfg.Server.Port)
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err = <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	infof("Shutting down, waiting up to %s for in-flight requests", cfg.Server.ShutdownTimeout)
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancelShutdown()
+
+	if err = srv.Shutdown(shutdownCtx); err != nil {
+		srv.Close()
+		return fmt.Errorf("Shutdown did not finish in time: %w", err)
+	}
+
+	infof("Server stopped")
+	return nil
+}
+
+func connect(cfg config.Database) (*pgxpool.Pool, error) {
+	poolConfig, err := pgxpool.ParseConfig(cfg.DSN)
+	if err != nil {
+		return nil, err
+	}
+	poolConfig.MaxConns = cfg.MaxConns
+	poolConfig.MinConns = cfg.MinConns
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ConnectTimeout)
+	defer cancel()
+
+	return pgxpool.ConnectConfig(ctx, poolConfig)
+}
+
+func newMailer(cfg config.Mail) mail.Mailer {
+	switch cfg.Driver {
+	case "smtp":
+		return mail.NewSMTPMailer(cfg.SMTPHost, cfg.SMTPPort, cfg.SMTPUsername, cfg.SMTPPassword, cfg.From)
+	case "file":
+		return mail.NewFileMailer(cfg.Dir)
+	default:
+		return mail.NewLogMailer()
 	}
-	log.Println("Server starts at port: " + port)
-	return srv.ListenAndServe()
 }
@@ -0,0 +1,130 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/me0888/twitter/pkg/models"
+	"github.com/me0888/twitter/pkg/users"
+)
+
+// Actions that can be denied to users who have not verified their email.
+const (
+	ActionPost    = "post"
+	ActionComment = "comment"
+	ActionFollow  = "follow"
+	ActionLike    = "like"
+	ActionRetweet = "retweet"
+	ActionAvatar  = "avatar"
+)
+
+// DefaultUnverifiedRestrictions lists the actions denied to unverified users
+// unless SetUnverifiedRestrictions says otherwise.
+var DefaultUnverifiedRestrictions = []string{ActionPost, ActionComment}
+
+var knownActions = map[string]bool{
+	ActionPost: true, ActionComment: true, ActionFollow: true, ActionLike: true, ActionRetweet: true, ActionAvatar: true,
+}
+
+// SetUnverifiedRestrictions replaces the set of actions denied to users who
+// have not verified their email. Unknown action names are rejected.
+func (s *Server) SetUnverifiedRestrictions(actions []string) error {
+	restricted := make(map[string]bool, len(actions))
+	for _, action := range actions {
+		if !knownActions[action] {
+			return fmt.Errorf("unknown action %q in unverified restrictions", action)
+		}
+		restricted[action] = true
+	}
+	s.restricted = restricted
+	return nil
+}
+
+// Verified reports whether user id may perform action and writes a 403
+// response when it may not.
+func (s *Server) Verified(writer http.ResponseWriter, request *http.Request, id int64, action string) bool {
+	if !s.restricted[action] {
+		return true
+	}
+
+	verified, err := s.usersSvc.EmailVerified(request.Context(), id)
+	if err != nil {
+		writeError(writer, request, err)
+		return false
+	}
+
+	if !verified {
+		writeError(writer, request, users.ErrEmailNotVerified)
+		return false
+	}
+
+	return true
+}
+
+func (s *Server) handleForgotPassword(writer http.ResponseWriter, request *http.Request) {
+	var in models.ForgotPasswordInput
+
+	if err := json.NewDecoder(request.Body).Decode(&in); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+
+	err := s.usersSvc.RequestPasswordReset(request.Context(), in.Email, language(request))
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+
+	writeJSON(writer, map[string]string{"status": "sent"}, http.StatusAccepted)
+
+}
+
+func (s *Server) handleResetPassword(writer http.ResponseWriter, request *http.Request) {
+	var in models.ResetPasswordInput
+
+	if err := json.NewDecoder(request.Body).Decode(&in); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+
+	err := s.usersSvc.ResetPassword(request.Context(), in.Token, in.Password)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+
+	writeJSON(writer, map[string]string{"status": "ok"}, http.StatusOK)
+
+}
+
+func (s *Server) handleSendVerification(writer http.ResponseWriter, request *http.Request) {
+	id := userID(request)
+
+	err := s.usersSvc.SendVerification(request.Context(), id, language(request))
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+
+	writeJSON(writer, map[string]string{"status": "sent"}, http.StatusAccepted)
+
+}
+
+func (s *Server) handleVerifyEmail(writer http.ResponseWriter, request *http.Request) {
+	var in models.VerifyEmailInput
+
+	if err := json.NewDecoder(request.Body).Decode(&in); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+
+	err := s.usersSvc.VerifyEmail(request.Context(), in.Token)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+
+	writeJSON(writer, map[string]bool{"email_verified": true}, http.StatusOK)
+
+}
@@ -0,0 +1,9 @@
+package database
+
+import "embed"
+
+// Migrations holds the numbered schema migrations,
+// migrations/NNNN_name.up.sql and the matching .down.sql.
+//
+//go:embed migrations/*.sql
+var Migrations embed.FS
@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS comment_likes;
+DROP TABLE IF EXISTS comments;
+DROP TABLE IF EXISTS tweet_retweets;
+DROP TABLE IF EXISTS tweet_likes;
+DROP TABLE IF EXISTS tweets;
+DROP TABLE IF EXISTS follows;
+DROP TABLE IF EXISTS users_tokens;
+DROP TABLE IF EXISTS users;
@@ -1,11 +1,5 @@
-DROP TABLE IF EXISTS users CASCADE; 
-DROP TABLE IF EXISTS users_tokens CASCADE; 
-DROP TABLE IF EXISTS tweets CASCADE;  
-DROP TABLE IF EXISTS tweet_likes CASCADE;  
-DROP TABLE IF EXISTS tweet_retweets CASCADE; 
-DROP TABLE IF EXISTS comments CASCADE;
-DROP TABLE IF EXISTS comment_likes CASCADE;  
-DROP TABLE IF EXISTS follows CASCADE;  
+-- The schema as it was first deployed. Tables are created only if missing,
+-- so databases created from the old schema.sql are adopted as version 1.
 
 CREATE TABLE IF NOT EXISTS users (
     id SERIAL NOT NULL PRIMARY KEY,
@@ -67,4 +61,4 @@ CREATE TABLE IF NOT EXISTS comment_likes (
    user_id INT NOT NULL REFERENCES users,
    comment_id INT NOT NULL REFERENCES comments,
    PRIMARY KEY (user_id, comment_id)
-);
\ No newline at end of file
+);
@@ -0,0 +1,25 @@
+DROP TABLE users_login_challenges;
+DROP TABLE users_action_tokens;
+DROP TABLE users_recovery_codes;
+DROP TABLE users_refresh_tokens;
+
+DELETE FROM users_tokens;
+
+DROP INDEX users_tokens_expire_idx;
+DROP INDEX users_tokens_user_id_idx;
+ALTER TABLE users_tokens DROP COLUMN last_seen;
+ALTER TABLE users_tokens DROP COLUMN scopes;
+ALTER TABLE users_tokens DROP COLUMN user_agent;
+ALTER TABLE users_tokens DROP COLUMN token_hash;
+ALTER TABLE users_tokens DROP COLUMN token_prefix;
+ALTER TABLE users_tokens DROP COLUMN id;
+ALTER TABLE users_tokens ADD COLUMN token TEXT NOT NULL UNIQUE;
+
+DROP INDEX users_email_lower_idx;
+
+ALTER TABLE users DROP COLUMN roles;
+ALTER TABLE users DROP COLUMN locale;
+ALTER TABLE users DROP COLUMN totp_last_counter;
+ALTER TABLE users DROP COLUMN totp_enabled;
+ALTER TABLE users DROP COLUMN totp_secret;
+ALTER TABLE users DROP COLUMN email_verified;
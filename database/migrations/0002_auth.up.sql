@@ -0,0 +1,63 @@
+-- Sessions with hashed access tokens, refresh tokens, two-factor
+-- authentication, email verification and profile preferences. Plaintext
+-- tokens cannot be trusted after this point, so every existing session is
+-- invalidated and clients have to log in again. Every statement tolerates a
+-- database created from a later revision of the old schema.sql.
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_counter BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS locale TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS roles TEXT[] NOT NULL DEFAULT '{user}';
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_lower_idx ON users (lower(email));
+
+DELETE FROM users_tokens;
+
+ALTER TABLE users_tokens DROP COLUMN IF EXISTS token;
+ALTER TABLE users_tokens ADD COLUMN IF NOT EXISTS id BIGSERIAL NOT NULL PRIMARY KEY;
+ALTER TABLE users_tokens ADD COLUMN IF NOT EXISTS token_prefix TEXT NOT NULL;
+ALTER TABLE users_tokens ADD COLUMN IF NOT EXISTS token_hash TEXT NOT NULL UNIQUE;
+ALTER TABLE users_tokens ADD COLUMN IF NOT EXISTS user_agent TEXT NOT NULL DEFAULT '';
+ALTER TABLE users_tokens ADD COLUMN IF NOT EXISTS scopes TEXT[] NOT NULL DEFAULT '{read,write}';
+ALTER TABLE users_tokens ADD COLUMN IF NOT EXISTS last_seen TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS users_tokens_token_prefix_idx ON users_tokens (token_prefix);
+CREATE INDEX IF NOT EXISTS users_tokens_user_id_idx ON users_tokens (user_id);
+CREATE INDEX IF NOT EXISTS users_tokens_expire_idx ON users_tokens (expire);
+
+CREATE TABLE IF NOT EXISTS users_refresh_tokens (
+   id         BIGSERIAL NOT NULL PRIMARY KEY,
+   session_id BIGINT NOT NULL REFERENCES users_tokens ON DELETE CASCADE,
+   token      TEXT NOT NULL UNIQUE,
+   expire     TIMESTAMP NOT NULL,
+   used_at    TIMESTAMP,
+   created    TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS users_refresh_tokens_session_id_idx ON users_refresh_tokens (session_id);
+
+CREATE TABLE IF NOT EXISTS users_recovery_codes (
+   id      BIGSERIAL NOT NULL PRIMARY KEY,
+   user_id BIGINT NOT NULL REFERENCES users ON DELETE CASCADE,
+   code    TEXT NOT NULL,
+   used_at TIMESTAMP,
+   UNIQUE (user_id, code)
+);
+
+CREATE TABLE IF NOT EXISTS users_action_tokens (
+   nonce   TEXT NOT NULL PRIMARY KEY,
+   user_id BIGINT NOT NULL REFERENCES users ON DELETE CASCADE,
+   purpose TEXT NOT NULL,
+   expire  TIMESTAMP NOT NULL,
+   used_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS users_login_challenges (
+   id        BIGSERIAL NOT NULL PRIMARY KEY,
+   challenge TEXT NOT NULL UNIQUE,
+   user_id   BIGINT NOT NULL REFERENCES users ON DELETE CASCADE,
+   attempts  INT NOT NULL DEFAULT 0,
+   expire    TIMESTAMP NOT NULL
+);
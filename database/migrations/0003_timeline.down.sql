@@ -0,0 +1,4 @@
+DROP INDEX tweet_retweets_user_id_created_at_idx;
+DROP INDEX tweets_user_id_created_at_idx;
+
+ALTER TABLE tweet_retweets DROP COLUMN created_at;
@@ -0,0 +1,6 @@
+-- Retweets record when they were made, so the home timeline can place them.
+-- Retweets made before this migration all get the time it ran.
+ALTER TABLE tweet_retweets ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+CREATE INDEX IF NOT EXISTS tweets_user_id_created_at_idx ON tweets (user_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS tweet_retweets_user_id_created_at_idx ON tweet_retweets (user_id, created_at DESC);
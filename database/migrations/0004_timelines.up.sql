@@ -0,0 +1,34 @@
+-- Home timelines filled on write: the latest event of every tweet a user
+-- sees, their own tweets and the tweets and retweets of the users they
+-- follow. Existing timelines are built from the current follows, keeping
+-- the newest 800 entries, the default timeline size.
+CREATE TABLE IF NOT EXISTS timelines (
+   user_id INT NOT NULL REFERENCES users ON DELETE CASCADE,
+   tweet_id INT NOT NULL REFERENCES tweets ON DELETE CASCADE,
+   at TIMESTAMPTZ NOT NULL,
+   retweeter_id INT REFERENCES users ON DELETE CASCADE,
+   PRIMARY KEY (user_id, tweet_id)
+);
+
+CREATE INDEX IF NOT EXISTS timelines_user_id_at_idx ON timelines (user_id, at DESC, tweet_id DESC);
+
+INSERT INTO timelines (user_id, tweet_id, at, retweeter_id)
+SELECT user_id, tweet_id, at, retweeter_id
+FROM (
+   SELECT latest.*, row_number() OVER (PARTITION BY user_id ORDER BY at DESC, tweet_id DESC) AS n
+   FROM (
+      SELECT DISTINCT ON (user_id, tweet_id) user_id, tweet_id, at, retweeter_id
+      FROM (
+         SELECT user_id, id AS tweet_id, created_at AS at, NULL::INT AS retweeter_id FROM tweets
+         UNION ALL
+         SELECT follows.follower_id, tweets.id, tweets.created_at, NULL::INT
+         FROM follows JOIN tweets ON tweets.user_id = follows.followee_id
+         UNION ALL
+         SELECT follows.follower_id, tweet_retweets.tweet_id, tweet_retweets.created_at, tweet_retweets.user_id
+         FROM follows JOIN tweet_retweets ON tweet_retweets.user_id = follows.followee_id
+      ) events
+      ORDER BY user_id, tweet_id, at DESC, retweeter_id NULLS FIRST
+   ) latest
+) ranked
+WHERE n <= 800
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,9 @@
+-- Replies are tweets. conversation_id is the id of the tweet that started
+-- the thread, the tweet itself for one that replies to nothing.
+ALTER TABLE tweets ADD COLUMN IF NOT EXISTS in_reply_to_tweet_id INT REFERENCES tweets ON DELETE SET NULL;
+ALTER TABLE tweets ADD COLUMN IF NOT EXISTS conversation_id INT;
+UPDATE tweets SET conversation_id = id WHERE conversation_id IS NULL;
+ALTER TABLE tweets ALTER COLUMN conversation_id SET NOT NULL;
+
+CREATE INDEX IF NOT EXISTS tweets_in_reply_to_tweet_id_idx ON tweets (in_reply_to_tweet_id, created_at, id);
+CREATE INDEX IF NOT EXISTS tweets_conversation_id_idx ON tweets (conversation_id);
@@ -0,0 +1,6 @@
+DROP INDEX comments_parent_id_created_at_idx;
+DROP INDEX comments_tweet_id_created_at_idx;
+
+ALTER TABLE comments DROP COLUMN replies_count;
+ALTER TABLE comments DROP COLUMN depth;
+ALTER TABLE comments DROP COLUMN parent_id;
@@ -0,0 +1,9 @@
+-- Comments can reply to other comments of the same tweet. depth is 0 for a
+-- comment on the tweet itself and one more than the parent's for a reply.
+-- Deleting a comment deletes the replies below it.
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS parent_id INT REFERENCES comments ON DELETE CASCADE;
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS depth INT NOT NULL DEFAULT 0;
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS replies_count INT NOT NULL DEFAULT 0 CHECK (replies_count >= 0);
+
+CREATE INDEX IF NOT EXISTS comments_tweet_id_created_at_idx ON comments (tweet_id, created_at DESC, id DESC) WHERE parent_id IS NULL;
+CREATE INDEX IF NOT EXISTS comments_parent_id_created_at_idx ON comments (parent_id, created_at DESC, id DESC);
@@ -0,0 +1,4 @@
+DROP INDEX tweets_quoted_tweet_id_idx;
+
+ALTER TABLE tweets DROP COLUMN quotes_count;
+ALTER TABLE tweets DROP COLUMN quoted_tweet_id;
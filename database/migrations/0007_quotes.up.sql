@@ -0,0 +1,7 @@
+-- A quote is a tweet that embeds another one. quoted_tweet_id has no foreign
+-- key: it stays when the quoted tweet is deleted, so that quotes can tell
+-- their readers it is gone.
+ALTER TABLE tweets ADD COLUMN IF NOT EXISTS quoted_tweet_id INT;
+ALTER TABLE tweets ADD COLUMN IF NOT EXISTS quotes_count INT NOT NULL DEFAULT 0 CHECK (quotes_count >= 0);
+
+CREATE INDEX IF NOT EXISTS tweets_quoted_tweet_id_idx ON tweets (quoted_tweet_id, created_at DESC, id DESC) WHERE quoted_tweet_id IS NOT NULL;
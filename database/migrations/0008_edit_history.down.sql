@@ -0,0 +1,5 @@
+DROP TABLE comment_revisions;
+DROP TABLE tweet_revisions;
+
+ALTER TABLE comments DROP COLUMN edits_count;
+ALTER TABLE tweets DROP COLUMN edits_count;
@@ -0,0 +1,21 @@
+-- Edited tweets and comments keep every earlier version as a revision:
+-- the content it had and when that content was written.
+ALTER TABLE tweets ADD COLUMN IF NOT EXISTS edits_count INT NOT NULL DEFAULT 0 CHECK (edits_count >= 0);
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS edits_count INT NOT NULL DEFAULT 0 CHECK (edits_count >= 0);
+
+CREATE TABLE IF NOT EXISTS tweet_revisions (
+   id SERIAL NOT NULL PRIMARY KEY,
+   tweet_id INT NOT NULL REFERENCES tweets ON DELETE CASCADE,
+   content TEXT NOT NULL,
+   created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS comment_revisions (
+   id SERIAL NOT NULL PRIMARY KEY,
+   comment_id INT NOT NULL REFERENCES comments ON DELETE CASCADE,
+   content TEXT NOT NULL,
+   created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS tweet_revisions_tweet_id_idx ON tweet_revisions (tweet_id, created_at, id);
+CREATE INDEX IF NOT EXISTS comment_revisions_comment_id_idx ON comment_revisions (comment_id, created_at, id);
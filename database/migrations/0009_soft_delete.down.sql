@@ -0,0 +1,19 @@
+-- Rows that are only marked deleted would come back without the column, so
+-- they are purged first.
+DELETE FROM comments WHERE deleted_at IS NOT NULL;
+DELETE FROM tweets WHERE deleted_at IS NOT NULL;
+
+ALTER TABLE comment_likes DROP CONSTRAINT comment_likes_comment_id_fkey,
+   ADD CONSTRAINT comment_likes_comment_id_fkey FOREIGN KEY (comment_id) REFERENCES comments;
+ALTER TABLE comments DROP CONSTRAINT comments_tweet_id_fkey,
+   ADD CONSTRAINT comments_tweet_id_fkey FOREIGN KEY (tweet_id) REFERENCES tweets;
+ALTER TABLE tweet_retweets DROP CONSTRAINT tweet_retweets_tweet_id_fkey,
+   ADD CONSTRAINT tweet_retweets_tweet_id_fkey FOREIGN KEY (tweet_id) REFERENCES tweets;
+ALTER TABLE tweet_likes DROP CONSTRAINT tweet_likes_tweet_id_fkey,
+   ADD CONSTRAINT tweet_likes_tweet_id_fkey FOREIGN KEY (tweet_id) REFERENCES tweets;
+
+DROP INDEX comments_deleted_at_idx;
+DROP INDEX tweets_deleted_at_idx;
+
+ALTER TABLE comments DROP COLUMN deleted_at;
+ALTER TABLE tweets DROP COLUMN deleted_at;
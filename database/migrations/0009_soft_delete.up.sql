@@ -0,0 +1,17 @@
+-- Deleted tweets and comments are only marked at first, so that deleting
+-- can be undone for a while. The purge worker removes them for good later,
+-- and with them everything that hangs off them.
+ALTER TABLE tweets ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS tweets_deleted_at_idx ON tweets (deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS comments_deleted_at_idx ON comments (deleted_at) WHERE deleted_at IS NOT NULL;
+
+ALTER TABLE tweet_likes DROP CONSTRAINT IF EXISTS tweet_likes_tweet_id_fkey,
+   ADD CONSTRAINT tweet_likes_tweet_id_fkey FOREIGN KEY (tweet_id) REFERENCES tweets ON DELETE CASCADE;
+ALTER TABLE tweet_retweets DROP CONSTRAINT IF EXISTS tweet_retweets_tweet_id_fkey,
+   ADD CONSTRAINT tweet_retweets_tweet_id_fkey FOREIGN KEY (tweet_id) REFERENCES tweets ON DELETE CASCADE;
+ALTER TABLE comments DROP CONSTRAINT IF EXISTS comments_tweet_id_fkey,
+   ADD CONSTRAINT comments_tweet_id_fkey FOREIGN KEY (tweet_id) REFERENCES tweets ON DELETE CASCADE;
+ALTER TABLE comment_likes DROP CONSTRAINT IF EXISTS comment_likes_comment_id_fkey,
+   ADD CONSTRAINT comment_likes_comment_id_fkey FOREIGN KEY (comment_id) REFERENCES comments ON DELETE CASCADE;
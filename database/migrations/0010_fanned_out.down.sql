@@ -0,0 +1,5 @@
+DROP INDEX tweet_retweets_unfanned_idx;
+DROP INDEX tweets_unfanned_idx;
+
+ALTER TABLE tweet_retweets DROP COLUMN fanned_out;
+ALTER TABLE tweets DROP COLUMN fanned_out;
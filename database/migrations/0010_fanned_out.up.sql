@@ -0,0 +1,16 @@
+-- Whether a tweet or retweet has been copied into the timelines of its
+-- author's followers. New rows start out not fanned out and are marked by
+-- the statement that copies them, so that until then, or for good when the
+-- author has too many followers, they are merged in when a timeline is read.
+-- Existing rows are decided by the current follower counts and the default
+-- fanout limit of 10000.
+ALTER TABLE tweets ADD COLUMN IF NOT EXISTS fanned_out BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE tweet_retweets ADD COLUMN IF NOT EXISTS fanned_out BOOLEAN NOT NULL DEFAULT FALSE;
+
+UPDATE tweets SET fanned_out = TRUE
+FROM users WHERE users.id = tweets.user_id AND users.followers_count < 10000;
+UPDATE tweet_retweets SET fanned_out = TRUE
+FROM users WHERE users.id = tweet_retweets.user_id AND users.followers_count < 10000;
+
+CREATE INDEX IF NOT EXISTS tweets_unfanned_idx ON tweets (user_id, created_at DESC) WHERE NOT fanned_out;
+CREATE INDEX IF NOT EXISTS tweet_retweets_unfanned_idx ON tweet_retweets (user_id, created_at DESC) WHERE NOT fanned_out;
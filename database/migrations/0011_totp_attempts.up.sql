@@ -0,0 +1,4 @@
+-- Codes tried to turn two-factor authentication off, counted per window so
+-- that a stolen session can not guess its way through.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_attempts INT NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_attempts_reset TIMESTAMP NOT NULL DEFAULT now();
@@ -0,0 +1,127 @@
+package apperr
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+)
+
+// Error is an error with a stable machine-readable code and the HTTP status
+// it is reported with. Services declare their sentinel errors with New so
+// that handlers can map them without knowing every package.
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func New(status int, code string, message string) *Error {
+	return &Error{Status: status, Code: code, Message: message}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+var (
+	ErrBadRequest   = New(http.StatusBadRequest, "bad_request", "bad request")
+	ErrInvalidBody  = New(http.StatusBadRequest, "invalid_body", "request body is not valid JSON")
+	ErrInvalidValue = New(http.StatusBadRequest, "invalid_argument", "invalid argument")
+	ErrValidation   = New(http.StatusUnprocessableEntity, "validation_failed", "some fields are invalid")
+	ErrUnauthorized = New(http.StatusUnauthorized, "unauthorized", "not authorized")
+	ErrForbidden    = New(http.StatusForbidden, "forbidden", "forbidden")
+	ErrNotFound     = New(http.StatusNotFound, "not_found", "not found")
+	ErrMethod       = New(http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+	ErrConflict     = New(http.StatusConflict, "conflict", "conflict")
+	ErrTooLarge     = New(http.StatusRequestEntityTooLarge, "too_large", "request body is too large")
+	ErrInternal     = New(http.StatusInternalServerError, "internal", "internal error")
+)
+
+// FieldErrors maps a JSON field name of the request body, or a query
+// parameter, to the code of the reason it was rejected. It is reported as
+// ErrValidation with the fields attached.
+type FieldErrors map[string]string
+
+func (e FieldErrors) Error() string {
+	fields := make([]string, 0, len(e))
+	for field, reason := range e {
+		fields = append(fields, field+": "+reason)
+	}
+	sort.Strings(fields)
+	return "invalid input: " + strings.Join(fields, "; ")
+}
+
+// Response is the JSON body written for a failed request.
+type Response struct {
+	Error Body `json:"error"`
+}
+
+type Body struct {
+	Code      string            `json:"code"`
+	Message   string            `json:"message"`
+	Fields    map[string]string `json:"fields,omitempty"`
+	RequestID string            `json:"request_id,omitempty"`
+}
+
+// From maps any error returned by a service to an *Error. Errors that are
+// neither declared with New nor recognised database or decoding failures
+// become ErrInternal, so raw driver messages never reach clients.
+func From(err error) *Error {
+	var appErr *Error
+	if errors.As(err, &appErr) {
+		return appErr
+	}
+
+	var fields FieldErrors
+	if errors.As(err, &fields) {
+		return ErrValidation
+	}
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrNotFound
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case "23505":
+			return ErrConflict
+		// Malformed input, out of range numbers and bad dates or times, such
+		// as a tampered cursor key cast to its column type.
+		case "22P02", "22003", "22007", "22008":
+			return ErrInvalidValue
+		}
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrInvalidBody
+	}
+
+	return ErrInternal
+}
+
+// UniqueViolation reports whether err is a unique constraint violation and
+// returns the name of the violated constraint.
+func UniqueViolation(err error) (string, bool) {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return pgErr.ConstraintName, true
+	}
+	return "", false
+}
+
+// ForeignKeyViolation reports whether err is a foreign key violation, i.e.
+// a referenced row does not exist.
+func ForeignKeyViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23503"
+}
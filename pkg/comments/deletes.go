@@ -0,0 +1,159 @@
+package comments
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/me0888/twitter/pkg/models"
+	"github.com/me0888/twitter/pkg/posts"
+)
+
+const purgeBatchSize = 1000
+
+// SetUndoWindow sets how long after deleting a comment it may be restored.
+func (s *Service) SetUndoWindow(window time.Duration) {
+	s.undoWindow = window
+}
+
+// SetRetention sets how long deleted comments are kept before Purge removes
+// them. It should not be shorter than the undo window.
+func (s *Service) SetRetention(retention time.Duration) {
+	s.retention = retention
+}
+
+// RestoreComment undoes the deletion of commentID and of the replies that
+// were deleted with it, while the undo window is open. A reply can not come
+// back while the comment it answers is deleted. Restoring a comment that is
+// not deleted changes nothing, so clients can retry it safely.
+func (s *Service) RestoreComment(ctx context.Context, id int64, commentID string) (models.Comment, error) {
+	var resp models.Comment
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return resp, fmt.Errorf("Error begin restore comment: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// The tweet is locked before the comment, in the order CreateComment and
+	// DeleteComment take them.
+	var tweetID int64
+	err = tx.QueryRow(ctx, `
+		SELECT tweets.id FROM comments JOIN tweets ON tweets.id = comments.tweet_id
+		WHERE comments.id = $1 AND tweets.deleted_at IS NULL
+		FOR UPDATE OF tweets`, commentID).Scan(&tweetID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return resp, ErrCommentNotFound
+	}
+	if err != nil {
+		return resp, fmt.Errorf("Error query select tweet: %w", err)
+	}
+
+	var ownerID int64
+	var parentID *int64
+	var deletedAt *time.Time
+	var restorable bool
+	err = tx.QueryRow(ctx, `
+		SELECT user_id, parent_id, deleted_at, deleted_at > now() - make_interval(secs => $2)
+		FROM comments WHERE id = $1 FOR UPDATE`, commentID, s.undoWindow.Seconds()).
+		Scan(&ownerID, &parentID, &deletedAt, &restorable)
+	if err != nil {
+		return resp, fmt.Errorf("Error query select comment: %w", err)
+	}
+
+	if ownerID != id {
+		return resp, ErrNotCommentOwner
+	}
+
+	if deletedAt != nil {
+		if !restorable {
+			return resp, posts.ErrUndoWindowClosed
+		}
+
+		if parentID != nil {
+			var parentVisible bool
+			err = tx.QueryRow(ctx, `SELECT deleted_at IS NULL FROM comments WHERE id = $1 FOR UPDATE`, *parentID).Scan(&parentVisible)
+			if err != nil {
+				return resp, fmt.Errorf("Error query select parent comment: %w", err)
+			}
+			if !parentVisible {
+				return resp, ErrCommentNotFound
+			}
+		}
+
+		tag, err := tx.Exec(ctx, `
+			WITH RECURSIVE subtree AS (
+				SELECT id FROM comments WHERE id = $1
+				UNION ALL
+				SELECT comments.id FROM comments JOIN subtree ON comments.parent_id = subtree.id
+				WHERE comments.deleted_at = $2
+			)
+			UPDATE comments SET deleted_at = NULL WHERE id IN (SELECT id FROM subtree)`, commentID, *deletedAt)
+		if err != nil {
+			return resp, fmt.Errorf("Error restore comment: %w", err)
+		}
+
+		_, err = tx.Exec(ctx, "UPDATE tweets SET comments_count = comments_count + $2 where id = $1", tweetID, tag.RowsAffected())
+		if err != nil {
+			return resp, fmt.Errorf("Error update tweet comments count: %w", err)
+		}
+		if parentID != nil {
+			_, err = tx.Exec(ctx, "UPDATE comments SET replies_count = replies_count + 1 WHERE id = $1", *parentID)
+			if err != nil {
+				return resp, fmt.Errorf("Error update comment replies count: %w", err)
+			}
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return resp, fmt.Errorf("Error commit restore comment: %w", err)
+	}
+
+	return s.GetComment(ctx, id, commentID)
+}
+
+// Purge removes for good the comments deleted longer than the retention ago,
+// together with their likes and revisions, a batch at a time. Comments on
+// purged tweets go with their tweet. It returns how many comments it
+// removed.
+func (s *Service) Purge(ctx context.Context) (int64, error) {
+	var purged int64
+	for {
+		tag, err := s.pool.Exec(ctx, `
+			DELETE FROM comments WHERE id IN (
+				SELECT id FROM comments WHERE deleted_at <= now() - make_interval(secs => $1)
+				ORDER BY id LIMIT $2)`, s.retention.Seconds(), purgeBatchSize)
+		if err != nil {
+			return purged, fmt.Errorf("Error purge comments: %w", err)
+		}
+		purged += tag.RowsAffected()
+		if tag.RowsAffected() < purgeBatchSize {
+			return purged, nil
+		}
+	}
+}
+
+// StartPurger runs Purge every interval until ctx is cancelled.
+func (s *Service) StartPurger(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := s.Purge(ctx)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			if n > 0 {
+				log.Printf("Purger removed %d deleted comments", n)
+			}
+		}
+	}
+}
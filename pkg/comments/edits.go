@@ -0,0 +1,119 @@
+package comments
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/me0888/twitter/pkg/models"
+	"github.com/me0888/twitter/pkg/posts"
+)
+
+// SetEditWindow sets how long after posting a comment may be edited.
+func (s *Service) SetEditWindow(window time.Duration) {
+	s.editWindow = window
+}
+
+// SetMaxEdits sets how many times a comment may be edited.
+func (s *Service) SetMaxEdits(n int) {
+	s.maxEdits = n
+}
+
+// UpdateComment replaces the content of comment.ID the way
+// posts.UpdateTweet does for tweets.
+func (s *Service) UpdateComment(ctx context.Context, id int64, comment models.Comment) (models.Comment, error) {
+	var resp models.Comment
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return resp, fmt.Errorf("Error begin update comment: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var ownerID int64
+	var content string
+	var writtenAt time.Time
+	var edits int
+	var editable bool
+	err = tx.QueryRow(ctx, `
+		SELECT user_id, content, updated_at, edits_count, created_at > now() - make_interval(secs => $2)
+		FROM comments WHERE id = $1 AND `+visible+` FOR UPDATE`, comment.ID, s.editWindow.Seconds()).
+		Scan(&ownerID, &content, &writtenAt, &edits, &editable)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return resp, ErrCommentNotFound
+	}
+	if err != nil {
+		return resp, fmt.Errorf("Error query select comment: %w", err)
+	}
+
+	if ownerID != id {
+		return resp, ErrNotCommentOwner
+	}
+
+	if content != comment.Content {
+		if !editable {
+			return resp, posts.ErrEditWindowClosed
+		}
+		if edits >= s.maxEdits {
+			return resp, posts.ErrEditLimitReached
+		}
+
+		if _, err = tx.Exec(ctx, `INSERT INTO comment_revisions (comment_id, content, created_at) VALUES ($1, $2, $3)`,
+			comment.ID, content, writtenAt); err != nil {
+			return resp, fmt.Errorf("Error insert comment revision: %w", err)
+		}
+		if _, err = tx.Exec(ctx, `UPDATE comments SET content = $2, updated_at = now(), edits_count = edits_count + 1 WHERE id = $1`,
+			comment.ID, comment.Content); err != nil {
+			return resp, fmt.Errorf("Error update comments: %w", err)
+		}
+	}
+
+	if err = tx.QueryRow(ctx, `SELECT `+commentColumns+` FROM comments WHERE id = $1`, comment.ID).Scan(commentFields(&resp)...); err != nil {
+		return resp, fmt.Errorf("Error query select comments: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return resp, fmt.Errorf("Error commit update comment: %w", err)
+	}
+
+	if err = s.fill(ctx, id, []*models.Comment{&resp}); err != nil {
+		return resp, err
+	}
+	return resp, nil
+}
+
+// GetCommentHistory returns commentID with the versions it had before its
+// edits.
+func (s *Service) GetCommentHistory(ctx context.Context, viewerID int64, commentID string) (models.CommentHistory, error) {
+	var history models.CommentHistory
+
+	comment, err := s.GetComment(ctx, viewerID, commentID)
+	if err != nil {
+		return history, err
+	}
+	history.Comment = comment
+
+	rows, err := s.pool.Query(ctx, `
+		SELECT content, created_at FROM comment_revisions
+		WHERE comment_id = $1
+		ORDER BY created_at, id`, comment.ID)
+	if err != nil {
+		return history, fmt.Errorf("Error query comment revisions: %w", err)
+	}
+	defer rows.Close()
+
+	history.Revisions = make([]models.Revision, 0)
+	for rows.Next() {
+		var r models.Revision
+		if err = rows.Scan(&r.Content, &r.CreatedAt); err != nil {
+			return history, fmt.Errorf("Error scan comment revision: %w", err)
+		}
+		history.Revisions = append(history.Revisions, r)
+	}
+	if err = rows.Err(); err != nil {
+		return history, fmt.Errorf("Error iterate comment revision rows: %w", err)
+	}
+	return history, nil
+}
@@ -0,0 +1,187 @@
+package comments
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/me0888/twitter/pkg/apperr"
+	"github.com/me0888/twitter/pkg/models"
+	"github.com/me0888/twitter/pkg/pagination"
+)
+
+// repliesShown is how many replies GetReplies embeds under each reply; the
+// others are read through the reply's more_cursor.
+const repliesShown = 3
+
+// Sort orders of comment lists.
+const (
+	SortNewest    = "newest"
+	SortOldest    = "oldest"
+	SortMostLiked = "most_liked"
+)
+
+// order is a sort order of comments: the keyset pages are read with, the
+// same ordering for window functions and the cursor of a comment in it.
+type order struct {
+	keys   pagination.Keyset
+	rank   string
+	cursor func(c *models.Comment) pagination.Cursor
+}
+
+func timeCursor(c *models.Comment) pagination.Cursor {
+	return pagination.TimeCursor(c.CreatedAt, c.ID)
+}
+
+var orders = map[string]order{
+	SortNewest: {
+		keys:   pagination.Keyset{Key: "comments.created_at", ID: "comments.id", Type: "timestamptz", Desc: true},
+		rank:   "created_at DESC, id DESC",
+		cursor: timeCursor,
+	},
+	SortOldest: {
+		keys:   pagination.Keyset{Key: "comments.created_at", ID: "comments.id", Type: "timestamptz"},
+		rank:   "created_at, id",
+		cursor: timeCursor,
+	},
+	SortMostLiked: {
+		keys: pagination.Keyset{Key: "comments.likes_count", ID: "comments.id", Type: "int", Desc: true},
+		rank: "likes_count DESC, id DESC",
+		cursor: func(c *models.Comment) pagination.Cursor {
+			return pagination.Cursor{Key: strconv.Itoa(c.LikesCount), ID: c.ID}
+		},
+	},
+}
+
+// commentOrder returns the order named sort; an empty name means newest.
+func commentOrder(sort string) (order, error) {
+	if sort == "" {
+		sort = SortNewest
+	}
+	o, ok := orders[sort]
+	if !ok {
+		return o, apperr.FieldErrors{"sort": "invalid_sort"}
+	}
+	return o, nil
+}
+
+// GetReplies returns commentID and a page of its direct replies in the given
+// sort order. Below them the replies of replies are shown until the tree is
+// depth levels deep, counted as posts.DefaultReplyDepth describes.
+func (s *Service) GetReplies(ctx context.Context, viewerID int64, commentID string, sort string, depth int, page pagination.Query) (models.CommentThread, error) {
+	var thread models.CommentThread
+
+	order, err := commentOrder(sort)
+	if err != nil {
+		return thread, err
+	}
+
+	thread.Comment, err = s.GetComment(ctx, viewerID, commentID)
+	if err != nil {
+		return thread, err
+	}
+
+	where, tail, args := order.keys.Clause(page, 2)
+	rows, err := s.pool.Query(ctx, `
+		SELECT `+commentColumns+`
+		FROM comments
+		WHERE parent_id = $1 AND deleted_at IS NULL
+		AND `+where+` `+tail, append([]interface{}{thread.Comment.ID}, args...)...)
+	if err != nil {
+		return thread, fmt.Errorf("Error query comment replies: %w", err)
+	}
+	defer rows.Close()
+
+	nodes := make([]models.CommentNode, 0)
+	for rows.Next() {
+		node := models.CommentNode{Replies: make([]models.CommentNode, 0)}
+		if err = rows.Scan(commentFields(&node.Comment)...); err != nil {
+			return thread, fmt.Errorf("Error scan comment reply: %w", err)
+		}
+		nodes = append(nodes, node)
+	}
+	if err = rows.Err(); err != nil {
+		return thread, fmt.Errorf("Error iterate comment reply rows: %w", err)
+	}
+
+	thread.Replies = page.Page(nodes, func(i int) pagination.Cursor {
+		return order.cursor(&nodes[i].Comment)
+	})
+	nodes = thread.Replies.Items.([]models.CommentNode)
+
+	level := make([]*models.CommentNode, len(nodes))
+	for i := range nodes {
+		level[i] = &nodes[i]
+	}
+	// Each query attaches the next level. Unlike tweets, comments keep a
+	// replies_count, so the last level needs no query to tell there are more.
+	for d := 2; d <= depth && len(level) > 0; d++ {
+		if level, err = s.nestedReplies(ctx, level, order); err != nil {
+			return thread, err
+		}
+	}
+
+	if err = s.fill(ctx, viewerID, appendNodeComments(nil, nodes)); err != nil {
+		return thread, err
+	}
+
+	return thread, nil
+}
+
+// nestedReplies gives each of parents its first replies in order and a
+// cursor to the rest when there are more. It returns the replies attached.
+func (s *Service) nestedReplies(ctx context.Context, parents []*models.CommentNode, order order) ([]*models.CommentNode, error) {
+	ids := make([]int64, len(parents))
+	byID := make(map[int64]*models.CommentNode, len(parents))
+	for i, parent := range parents {
+		ids[i] = parent.ID
+		byID[parent.ID] = parent
+	}
+
+	rows, err := s.pool.Query(ctx, `
+		SELECT `+commentColumns+`
+		FROM (
+			SELECT id, row_number() OVER (PARTITION BY parent_id ORDER BY `+order.rank+`) AS n
+			FROM comments WHERE parent_id = ANY($1) AND deleted_at IS NULL
+		) ranked
+		JOIN comments ON comments.id = ranked.id
+		WHERE ranked.n <= $2
+		ORDER BY comments.parent_id, ranked.n`, ids, repliesShown+1)
+	if err != nil {
+		return nil, fmt.Errorf("Error query nested comment replies: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		node := models.CommentNode{Replies: make([]models.CommentNode, 0)}
+		if err = rows.Scan(commentFields(&node.Comment)...); err != nil {
+			return nil, fmt.Errorf("Error scan nested comment reply: %w", err)
+		}
+		parent := byID[*node.ParentID]
+		if len(parent.Replies) < repliesShown {
+			parent.Replies = append(parent.Replies, node)
+			continue
+		}
+		more := order.cursor(&parent.Replies[len(parent.Replies)-1].Comment).Encode()
+		parent.MoreCursor = &more
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error iterate nested comment reply rows: %w", err)
+	}
+
+	next := make([]*models.CommentNode, 0)
+	for _, parent := range parents {
+		for i := range parent.Replies {
+			next = append(next, &parent.Replies[i])
+		}
+	}
+	return next, nil
+}
+
+func appendNodeComments(comments []*models.Comment, nodes []models.CommentNode) []*models.Comment {
+	for i := range nodes {
+		comments = append(comments, &nodes[i].Comment)
+		comments = appendNodeComments(comments, nodes[i].Replies)
+	}
+	return comments
+}
@@ -2,181 +2,390 @@ package comments
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/me0888/twitter/pkg/apperr"
 	"github.com/me0888/twitter/pkg/models"
+	"github.com/me0888/twitter/pkg/pagination"
+	"github.com/me0888/twitter/pkg/posts"
 )
 
+var ErrCommentNotFound = apperr.New(http.StatusNotFound, "comment_not_found", "comment not found")
+var ErrNotCommentOwner = apperr.New(http.StatusForbidden, "not_comment_owner", "comment belongs to another user")
+var ErrCommentTooDeep = apperr.New(http.StatusBadRequest, "comment_too_deep", "replies can not be nested this deep")
+var ErrParentOtherTweet = apperr.New(http.StatusBadRequest, "comment_parent_mismatch", "parent comment belongs to another tweet")
+
+// DefaultMaxDepth is how deep replies to comments may be nested unless
+// SetMaxDepth says otherwise. Comments on the tweet itself have depth 0.
+const DefaultMaxDepth = 5
+
+// Users are listed by username.
+var userKeys = pagination.Keyset{Key: "users.username", ID: "users.id", Type: "text"}
+
+// commentColumns are the columns commentFields scans, in the same order.
+const commentColumns = `comments.id, comments.tweet_id, comments.parent_id, comments.content, comments.likes_count,
+	comments.replies_count, comments.edits_count > 0, comments.created_at, comments.updated_at`
+
+func commentFields(c *models.Comment) []interface{} {
+	return []interface{}{&c.ID, &c.TweetID, &c.ParentID, &c.Content, &c.LikesCount, &c.RepliesCount, &c.Edited, &c.CreatedAt, &c.UpdatedAt}
+}
+
+// visible selects the comments that are neither deleted nor on a deleted
+// tweet.
+const visible = `comments.deleted_at IS NULL AND comments.tweet_id IN (SELECT id FROM tweets WHERE deleted_at IS NULL)`
+
 type Service struct {
-	pool *pgxpool.Pool
+	pool       *pgxpool.Pool
+	maxDepth   int
+	editWindow time.Duration
+	maxEdits   int
+	undoWindow time.Duration
+	retention  time.Duration
 }
 
 func NewService(pool *pgxpool.Pool) *Service {
-	return &Service{pool: pool}
+	return &Service{pool: pool, maxDepth: DefaultMaxDepth, editWindow: posts.DefaultEditWindow, maxEdits: posts.DefaultMaxEdits,
+		undoWindow: posts.DefaultUndoWindow, retention: posts.DefaultRetention}
+}
+
+// SetMaxDepth sets how deep replies may be nested; 0 allows no replies.
+func (s *Service) SetMaxDepth(depth int) {
+	s.maxDepth = depth
 }
 
-func (s *Service) CreateComment(ctx context.Context, userID int64, tweetID, content string) (models.Comment, error) {
+// CreateComment comments on tweetID, or replies to parentID when it is set.
+// The tweet and the parent are locked while their counters change.
+func (s *Service) CreateComment(ctx context.Context, userID int64, tweetID, content string, parentID *int64) (models.Comment, error) {
 	var comment models.Comment
 
-	err := s.pool.QueryRow(ctx, `INSERT INTO comments (tweet_id, user_id, likes_count, content) VALUES($1, $2, $3, $4) 
-								RETURNING id, likes_count, content, created_at, updated_at`, tweetID, userID, 0, content).
-		Scan(&comment.ID, &comment.LikesCount, &comment.Content, &comment.CreatedAt, &comment.UpdatedAt)
+	tx, err := s.pool.Begin(ctx)
 	if err != nil {
-		return comment, fmt.Errorf("Error incert comment: %v", err)
+		return comment, fmt.Errorf("Error begin comment: %w", err)
 	}
+	defer tx.Rollback(ctx)
 
-	if _, err = s.pool.Exec(ctx, "UPDATE tweets SET comments_count = comments_count + 1 where id = $1", tweetID); err != nil {
-		return comment, fmt.Errorf("Error update tweet comments count: %v", err)
+	var tweet int64
+	err = tx.QueryRow(ctx, `SELECT id FROM tweets WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`, tweetID).Scan(&tweet)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return comment, posts.ErrTweetNotFound
+	}
+	if err != nil {
+		return comment, fmt.Errorf("Error query select tweet: %w", err)
 	}
 
+	depth := 0
+	if parentID != nil {
+		var parentTweet int64
+		err = tx.QueryRow(ctx, `SELECT tweet_id, depth FROM comments WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`, *parentID).Scan(&parentTweet, &depth)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return comment, ErrCommentNotFound
+		}
+		if err != nil {
+			return comment, fmt.Errorf("Error query select parent comment: %w", err)
+		}
+		if parentTweet != tweet {
+			return comment, ErrParentOtherTweet
+		}
+		depth++
+		if depth > s.maxDepth {
+			return comment, ErrCommentTooDeep
+		}
+	}
+
+	err = tx.QueryRow(ctx, `INSERT INTO comments (tweet_id, user_id, parent_id, depth, likes_count, content) VALUES($1, $2, $3, $4, 0, $5) 
+								RETURNING `+commentColumns, tweet, userID, parentID, depth, content).
+		Scan(commentFields(&comment)...)
+	if err != nil {
+		return comment, fmt.Errorf("Error incert comment: %w", err)
+	}
+
+	if _, err = tx.Exec(ctx, "UPDATE tweets SET comments_count = comments_count + 1 where id = $1", tweet); err != nil {
+		return comment, fmt.Errorf("Error update tweet comments count: %w", err)
+	}
+	if parentID != nil {
+		if _, err = tx.Exec(ctx, "UPDATE comments SET replies_count = replies_count + 1 WHERE id = $1", *parentID); err != nil {
+			return comment, fmt.Errorf("Error update comment replies count: %w", err)
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return comment, fmt.Errorf("Error commit comment: %w", err)
+	}
+
+	comment.UserID = userID
 	return comment, nil
 }
 
-func (s *Service) GetComments(ctx context.Context, tweetID string) ([]models.Comment, error) {
+// GetComments returns a page of the comments on tweetID itself, in the
+// given sort order; replies are read with GetReplies.
+func (s *Service) GetComments(ctx context.Context, viewerID int64, tweetID string, sort string, page pagination.Query) (pagination.Page, error) {
+	order, err := commentOrder(sort)
+	if err != nil {
+		return pagination.Page{}, err
+	}
 
+	where, tail, args := order.keys.Clause(page, 2)
 	rows, err := s.pool.Query(ctx, `
-	SELECT id, content, likes_count, created_at, updated_at
+	SELECT `+commentColumns+`
 	FROM comments
-	WHERE comments.tweet_id = $1
-	ORDER BY created_at DESC`, tweetID)
+	WHERE comments.tweet_id = $1 AND comments.parent_id IS NULL AND `+visible+`
+	AND `+where+` `+tail, append([]interface{}{tweetID}, args...)...)
 	if err != nil {
-		return nil, fmt.Errorf("Error query comments: %v", err)
+		return pagination.Page{}, fmt.Errorf("Error query comments: %w", err)
 	}
 	defer rows.Close()
 	cc := make([]models.Comment, 0)
 	for rows.Next() {
 		var c models.Comment
-		if err = rows.Scan(&c.ID, &c.Content, &c.LikesCount, &c.CreatedAt, &c.UpdatedAt); err != nil {
-			return nil, fmt.Errorf("Error scan comment: %v", err)
+		if err = rows.Scan(commentFields(&c)...); err != nil {
+			return pagination.Page{}, fmt.Errorf("Error scan comment: %w", err)
 		}
 		cc = append(cc, c)
 	}
 	if err = rows.Err(); err != nil {
-		return nil, fmt.Errorf("Error iterate comment rows: %v", err)
+		return pagination.Page{}, fmt.Errorf("Error iterate comment rows: %w", err)
+	}
+
+	refs := make([]*models.Comment, len(cc))
+	for i := range cc {
+		refs[i] = &cc[i]
+	}
+	if err = s.fill(ctx, viewerID, refs); err != nil {
+		return pagination.Page{}, err
 	}
-	return cc, nil
+	return page.Page(cc, func(i int) pagination.Cursor {
+		return order.cursor(&cc[i])
+	}), nil
 }
 
-func (s *Service) GetComment(ctx context.Context, commentID string) (models.Comment, error) {
+func (s *Service) GetComment(ctx context.Context, viewerID int64, commentID string) (models.Comment, error) {
 	var comment models.Comment
 	err := s.pool.QueryRow(ctx, `
-	SELECT id, content, likes_count, created_at, updated_at
+	SELECT `+commentColumns+`
 	FROM comments
-	WHERE id = $1
-	ORDER BY created_at DESC`, commentID).Scan(&comment.ID, &comment.Content, &comment.LikesCount, &comment.CreatedAt, &comment.UpdatedAt)
+	WHERE id = $1 AND `+visible, commentID).Scan(commentFields(&comment)...)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return comment, ErrCommentNotFound
+	}
 	if err != nil {
-		return comment, fmt.Errorf("Error query select comments: %v", err)
+		return comment, fmt.Errorf("Error query select comments: %w", err)
+	}
+	if err = s.fill(ctx, viewerID, []*models.Comment{&comment}); err != nil {
+		return comment, err
 	}
 
 	return comment, nil
 }
 
-func (s *Service) UpdateComment(ctx context.Context, id int64, comment models.Comment) (models.Tweet, error) {
-	var resp models.Tweet
-	var response models.LikeResponse
+// fill sets the author of every comment and the flags that depend on who is
+// looking, with one query for all of them.
+func (s *Service) fill(ctx context.Context, viewerID int64, comments []*models.Comment) error {
+	if len(comments) == 0 {
+		return nil
+	}
 
-	if err := s.pool.QueryRow(ctx, `
-	SELECT EXISTS (SELECT 1 FROM comments WHERE id = $1 AND user_id = $2)`, comment.ID, id).
-		Scan(&response.Liked); err != nil {
-		return resp, fmt.Errorf("Error query select comment : %v", err)
+	ids := make([]int64, 0, len(comments))
+	byID := make(map[int64][]*models.Comment, len(comments))
+	for _, c := range comments {
+		if _, ok := byID[c.ID]; !ok {
+			ids = append(ids, c.ID)
+		}
+		byID[c.ID] = append(byID[c.ID], c)
+	}
+
+	rows, err := s.pool.Query(ctx, `
+		SELECT comments.id, users.id, users.username, COALESCE(users.avatar, ''),
+			EXISTS (SELECT 1 FROM comment_likes WHERE user_id = $2 AND comment_id = comments.id)
+		FROM comments JOIN users ON users.id = comments.user_id
+		WHERE comments.id = ANY($1)`, ids, viewerID)
+	if err != nil {
+		return fmt.Errorf("Error query comment authors: %w", err)
 	}
+	defer rows.Close()
 
-	if response.Liked {
-		if _, err := s.pool.Exec(ctx, "UPDATE comments SET content=$2, updated_at=$3 WHERE id = $1 ",
-			comment.ID, comment.Content, comment.UpdatedAt); err != nil {
-			return resp, fmt.Errorf("Error update comments: %v", err)
+	for rows.Next() {
+		var id, authorID int64
+		var username, avatar string
+		var liked bool
+		if err = rows.Scan(&id, &authorID, &username, &avatar, &liked); err != nil {
+			return fmt.Errorf("Error scan comment author: %w", err)
+		}
+		for _, c := range byID[id] {
+			c.UserID = authorID
+			c.Author = models.NewUserRef(authorID, username, avatar)
+			c.LikedByMe = liked
+			c.IsMine = authorID == viewerID
 		}
-	} else {
-		return resp, fmt.Errorf("Error update comments")
 	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("Error iterate comment author rows: %w", err)
+	}
+	return nil
+}
 
-	return resp, nil
+// commentOwner returns the author of commentID and the tweet it belongs to,
+// or ErrCommentNotFound.
+func (s *Service) commentOwner(ctx context.Context, commentID string) (userID int64, tweetID int64, err error) {
+	err = s.pool.QueryRow(ctx, `SELECT user_id, tweet_id FROM comments WHERE id = $1 AND `+visible, commentID).Scan(&userID, &tweetID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, 0, ErrCommentNotFound
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("Error query select comment : %w", err)
+	}
+
+	return userID, tweetID, nil
 }
 
+// DeleteComment hides commentID together with the replies under it, and
+// takes all of them off the tweet's comment count, until RestoreComment
+// brings them back or Purge removes them. The replies are marked with the
+// same time as the comment, which tells them apart from replies deleted on
+// their own before.
 func (s *Service) DeleteComment(ctx context.Context, id int64, commentID string) (models.Comment, error) {
 	var resp models.Comment
-	var response models.LikeResponse
-	var tweetID int64
 
-	if err := s.pool.QueryRow(ctx, `
-	SELECT EXISTS (SELECT 1 FROM comments WHERE id = $1 AND user_id = $2)`, commentID, id).
-		Scan(&response.Liked); err != nil {
-		return resp, fmt.Errorf("Error query select comment : %v", err)
+	ownerID, tweetID, err := s.commentOwner(ctx, commentID)
+	if err != nil {
+		return resp, err
 	}
 
-	if response.Liked {
-		err := s.pool.QueryRow(ctx, `SELECT tweet_id FROM comments WHERE id = $1`,
-			commentID).Scan(&tweetID)
-		if err != nil {
-			return resp, fmt.Errorf("Error select  tweet_id : %v", err)
-		}
+	if ownerID != id {
+		return resp, ErrNotCommentOwner
+	}
 
-		err = s.pool.QueryRow(ctx, `DELETE FROM comments WHERE id = $1 
-		RETURNING id, content, likes_count, created_at, updated_at`,
-			commentID).Scan(&resp.ID, &resp.Content, &resp.LikesCount, &resp.CreatedAt, &resp.UpdatedAt)
-		if err != nil {
-			return resp, fmt.Errorf("Error delete comment: %v", err)
-		}
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return resp, fmt.Errorf("Error begin delete comment: %w", err)
+	}
+	defer tx.Rollback(ctx)
 
-		_, err = s.pool.Exec(ctx, "UPDATE tweets SET comments_count = comments_count -1 where id = $1", tweetID)
+	if _, err = tx.Exec(ctx, `SELECT id FROM tweets WHERE id = $1 FOR UPDATE`, tweetID); err != nil {
+		return resp, fmt.Errorf("Error query select tweet: %w", err)
+	}
+
+	err = tx.QueryRow(ctx, `UPDATE comments SET deleted_at = now() WHERE id = $1 AND deleted_at IS NULL
+		RETURNING `+commentColumns+`, comments.deleted_at`, commentID).Scan(append(commentFields(&resp), &resp.DeletedAt)...)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return resp, ErrCommentNotFound
+	}
+	if err != nil {
+		return resp, fmt.Errorf("Error delete comment: %w", err)
+	}
+
+	tag, err := tx.Exec(ctx, `
+		WITH RECURSIVE subtree AS (
+			SELECT id FROM comments WHERE parent_id = $1 AND deleted_at IS NULL
+			UNION ALL
+			SELECT comments.id FROM comments JOIN subtree ON comments.parent_id = subtree.id
+			WHERE comments.deleted_at IS NULL
+		)
+		UPDATE comments SET deleted_at = $2 WHERE id IN (SELECT id FROM subtree)`, resp.ID, resp.DeletedAt)
+	if err != nil {
+		return resp, fmt.Errorf("Error delete comment replies: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, "UPDATE tweets SET comments_count = comments_count - $2 where id = $1", tweetID, 1+tag.RowsAffected())
+	if err != nil {
+		return resp, fmt.Errorf("Error update tweet comments count: %w", err)
+	}
+	if resp.ParentID != nil {
+		_, err = tx.Exec(ctx, "UPDATE comments SET replies_count = replies_count - 1 WHERE id = $1", *resp.ParentID)
 		if err != nil {
-			return resp, fmt.Errorf("Error update tweet comments count: %v", err)
+			return resp, fmt.Errorf("Error update comment replies count: %w", err)
 		}
+	}
 
-	} else {
-		return resp, fmt.Errorf("Error delete comment")
+	if err = tx.Commit(ctx); err != nil {
+		return resp, fmt.Errorf("Error commit delete comment: %w", err)
 	}
 
+	resp.UserID = ownerID
 	return resp, nil
 }
 
+// CommentLike toggles the like of userID on commentID.
 func (s *Service) CommentLike(ctx context.Context, userID int64, commentID string) (models.LikeResponse, error) {
+	return s.setCommentLike(ctx, userID, commentID, nil)
+}
+
+// SetCommentLike likes or unlikes commentID. Repeating the call changes
+// nothing, so clients can retry it safely.
+func (s *Service) SetCommentLike(ctx context.Context, userID int64, commentID string, liked bool) (models.LikeResponse, error) {
+	return s.setCommentLike(ctx, userID, commentID, &liked)
+}
+
+// setCommentLike brings the like to the wanted state, or flips it when
+// wanted is nil, in one transaction holding the comment row lock.
+func (s *Service) setCommentLike(ctx context.Context, userID int64, commentID string, wanted *bool) (models.LikeResponse, error) {
 	var response models.LikeResponse
 
-	if err := s.pool.QueryRow(ctx, `SELECT EXISTS (
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return response, fmt.Errorf("Error begin comment like: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.QueryRow(ctx, `SELECT likes_count FROM comments WHERE id = $1 AND `+visible+` FOR UPDATE`, commentID).Scan(&response.LikesCount)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return response, ErrCommentNotFound
+	}
+	if err != nil {
+		return response, fmt.Errorf("Error query select comment: %w", err)
+	}
+
+	if err = tx.QueryRow(ctx, `SELECT EXISTS (
             SELECT 1 FROM comment_likes WHERE user_id = $1 AND comment_id = $2
         )
     `, userID, commentID).Scan(&response.Liked); err != nil {
-		return response, fmt.Errorf("Error query select comment like : %v", err)
+		return response, fmt.Errorf("Error query select comment like : %w", err)
 	}
 
-	if response.Liked {
-
-		if _, err := s.pool.Exec(ctx, "DELETE FROM comment_likes WHERE user_id = $1 AND comment_id = $2", userID, commentID); err != nil {
-			return response, fmt.Errorf("Error query delete comment like: %v", err)
-		}
-
-		if err := s.pool.QueryRow(ctx, "UPDATE comments SET likes_count = likes_count - 1 WHERE id = $1 RETURNING likes_count", commentID).Scan(&response.LikesCount); err != nil {
-			return response, fmt.Errorf("Error update comment likes count: %v", err)
-		}
-	} else {
-
-		_, err := s.pool.Exec(ctx, "INSERT INTO comment_likes (user_id, comment_id) VALUES ($1, $2)", userID, commentID)
+	liked := !response.Liked
+	if wanted != nil {
+		liked = *wanted
+	}
+	if liked == response.Liked {
+		return response, nil
+	}
 
-		if err != nil {
-			return response, fmt.Errorf("Error insert comment like: %v", err)
-		}
+	query, delta := "INSERT INTO comment_likes (user_id, comment_id) VALUES ($1, $2)", 1
+	if !liked {
+		query, delta = "DELETE FROM comment_likes WHERE user_id = $1 AND comment_id = $2", -1
+	}
+	if _, err = tx.Exec(ctx, query, userID, commentID); err != nil {
+		return response, fmt.Errorf("Error update comment like: %w", err)
+	}
 
-		if err := s.pool.QueryRow(ctx, "UPDATE comments SET likes_count = likes_count + 1 WHERE id = $1 RETURNING likes_count", commentID).Scan(&response.LikesCount); err != nil {
-			return response, fmt.Errorf("Error update comments likes count: %v", err)
-		}
+	if err = tx.QueryRow(ctx, "UPDATE comments SET likes_count = likes_count + $2 WHERE id = $1 RETURNING likes_count", commentID, delta).
+		Scan(&response.LikesCount); err != nil {
+		return response, fmt.Errorf("Error update comment likes count: %w", err)
+	}
 
+	if err = tx.Commit(ctx); err != nil {
+		return response, fmt.Errorf("Error commit comment like: %w", err)
 	}
 
-	response.Liked = !response.Liked
+	response.Liked = liked
 	return response, nil
 }
 
-func (s *Service) GetCommetsLikedUsers(ctx context.Context, commentID string) ([]models.UserProfile, error) {
+func (s *Service) GetCommetsLikedUsers(ctx context.Context, commentID string, page pagination.Query) (pagination.Page, error) {
+	where, tail, args := userKeys.Clause(page, 2)
 	rows, err := s.pool.Query(ctx, `
 		SELECT id, email, username, followers_count, followees_count
 		FROM comment_likes, users
 		WHERE comment_likes.comment_id = $1 
+		AND comment_likes.comment_id IN (SELECT id FROM comments WHERE `+visible+`)
 		AND users.id=comment_likes.user_id
-		ORDER BY username ASC
-		`, commentID)
+		AND `+where+` `+tail, append([]interface{}{commentID}, args...)...)
 	if err != nil {
-		return nil, fmt.Errorf("Error query select : %v", err)
+		return pagination.Page{}, fmt.Errorf("Error query select : %w", err)
 	}
 	defer rows.Close()
 	uu := make([]models.UserProfile, 0)
@@ -184,13 +393,15 @@ func (s *Service) GetCommetsLikedUsers(ctx context.Context, commentID string) ([
 		var u models.UserProfile
 
 		if err = rows.Scan(&u.ID, &u.Email, &u.UserName, &u.FollowersCount, &u.FolloweesCount); err != nil {
-			return nil, fmt.Errorf("Error scan user: %v", err)
+			return pagination.Page{}, fmt.Errorf("Error scan user: %w", err)
 		}
 
 		uu = append(uu, u)
 	}
 	if err = rows.Err(); err != nil {
-		return nil, fmt.Errorf("Error iterate user rows: %v", err)
+		return pagination.Page{}, fmt.Errorf("Error iterate user rows: %w", err)
 	}
-	return uu, nil
+	return page.Page(uu, func(i int) pagination.Cursor {
+		return pagination.Cursor{Key: uu[i].UserName, ID: uu[i].ID}
+	}), nil
 }
@@ -0,0 +1,148 @@
+package config
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// setting is one configuration value that can be overridden by name from the
+// environment or the command line.
+type setting struct {
+	name  string
+	env   string
+	usage string
+	get   func() string
+	set   func(string) error
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		stringSetting("host", "TWITTER_HOST", "address to listen on", &c.Server.Host),
+		stringSetting("port", "TWITTER_PORT", "port to listen on", &c.Server.Port),
+		durationSetting("read-timeout", "TWITTER_READ_TIMEOUT", "maximum time to read a request, 0 for none", &c.Server.ReadTimeout),
+		durationSetting("read-header-timeout", "TWITTER_READ_HEADER_TIMEOUT", "maximum time to read request headers, 0 for none", &c.Server.ReadHeaderTimeout),
+		durationSetting("write-timeout", "TWITTER_WRITE_TIMEOUT", "maximum time to write a response, 0 for none", &c.Server.WriteTimeout),
+		durationSetting("idle-timeout", "TWITTER_IDLE_TIMEOUT", "how long keep-alive connections stay open, 0 for none", &c.Server.IdleTimeout),
+		durationSetting("shutdown-timeout", "TWITTER_SHUTDOWN_TIMEOUT", "how long in-flight requests may take to finish on shutdown", &c.Server.ShutdownTimeout),
+		stringSetting("dsn", "TWITTER_DSN", "PostgreSQL connection string", &c.Database.DSN),
+		int32Setting("db-max-conns", "TWITTER_DB_MAX_CONNS", "maximum pool connections", &c.Database.MaxConns),
+		int32Setting("db-min-conns", "TWITTER_DB_MIN_CONNS", "minimum idle pool connections", &c.Database.MinConns),
+		durationSetting("db-connect-timeout", "TWITTER_DB_CONNECT_TIMEOUT", "timeout of the first connection", &c.Database.ConnectTimeout),
+		stringSetting("secret", "TWITTER_SECRET", "key signing reset and verification tokens", &c.Auth.Secret),
+		durationSetting("access-token-ttl", "TWITTER_ACCESS_TOKEN_TTL", "lifetime of access tokens", &c.Auth.AccessTokenTTL),
+		durationSetting("refresh-token-ttl", "TWITTER_REFRESH_TOKEN_TTL", "lifetime of refresh tokens", &c.Auth.RefreshTokenTTL),
+		durationSetting("token-sweep-interval", "TWITTER_TOKEN_SWEEP_INTERVAL", "how often expired tokens are deleted", &c.Auth.TokenSweepInterval),
+		stringSetting("password-denylist", "TWITTER_PASSWORD_DENYLIST", "file of breached passwords", &c.Auth.PasswordDenylist),
+		uint32Setting("argon2-memory", "TWITTER_ARGON2_MEMORY", "argon2id memory in KiB", &c.Auth.Argon2Memory),
+		uint32Setting("argon2-iterations", "TWITTER_ARGON2_ITERATIONS", "argon2id passes", &c.Auth.Argon2Iterations),
+		uint8Setting("argon2-parallelism", "TWITTER_ARGON2_PARALLELISM", "argon2id lanes", &c.Auth.Argon2Parallelism),
+		stringSetting("mail-driver", "TWITTER_MAIL_DRIVER", "smtp, file or log", &c.Mail.Driver),
+		stringSetting("mail-dir", "TWITTER_MAIL_DIR", "directory of the file mail driver", &c.Mail.Dir),
+		stringSetting("mail-from", "TWITTER_MAIL_FROM", "sender address", &c.Mail.From),
+		stringSetting("smtp-host", "TWITTER_SMTP_HOST", "SMTP server host", &c.Mail.SMTPHost),
+		stringSetting("smtp-port", "TWITTER_SMTP_PORT", "SMTP server port", &c.Mail.SMTPPort),
+		stringSetting("smtp-username", "TWITTER_SMTP_USERNAME", "SMTP user", &c.Mail.SMTPUsername),
+		stringSetting("smtp-password", "TWITTER_SMTP_PASSWORD", "SMTP password", &c.Mail.SMTPPassword),
+		stringSetting("avatars-dir", "TWITTER_AVATARS_DIR", "directory avatars are stored in", &c.Avatars.Dir),
+		int64Setting("avatars-max-upload-size", "TWITTER_AVATARS_MAX_UPLOAD_SIZE", "largest accepted avatar upload in bytes", &c.Avatars.MaxUploadSize),
+		durationSetting("counters-reconcile-interval", "TWITTER_COUNTERS_RECONCILE_INTERVAL", "how often drifted counters are fixed, 0 to disable", &c.Counters.ReconcileInterval),
+		intSetting("counters-batch-size", "TWITTER_COUNTERS_BATCH_SIZE", "rows recounted per transaction", &c.Counters.BatchSize),
+		intSetting("timeline-size", "TWITTER_TIMELINE_SIZE", "entries kept in each home timeline", &c.Timeline.Size),
+		intSetting("timeline-fanout-limit", "TWITTER_TIMELINE_FANOUT_LIMIT", "followers from which tweets are merged into timelines on read", &c.Timeline.FanoutLimit),
+		intSetting("timeline-queue-size", "TWITTER_TIMELINE_QUEUE_SIZE", "timeline updates waiting for the worker", &c.Timeline.QueueSize),
+		durationSetting("timeline-trim-interval", "TWITTER_TIMELINE_TRIM_INTERVAL", "how often timelines are trimmed to size", &c.Timeline.TrimInterval),
+		intSetting("comments-max-depth", "TWITTER_COMMENTS_MAX_DEPTH", "how deep replies to comments may be nested", &c.Comments.MaxDepth),
+		durationSetting("edits-window", "TWITTER_EDITS_WINDOW", "how long after posting tweets and comments may be edited", &c.Edits.Window),
+		intSetting("edits-max-count", "TWITTER_EDITS_MAX_COUNT", "how many times a tweet or comment may be edited", &c.Edits.MaxCount),
+		durationSetting("deletes-undo-window", "TWITTER_DELETES_UNDO_WINDOW", "how long deleted tweets and comments can be restored", &c.Deletes.UndoWindow),
+		durationSetting("deletes-retention", "TWITTER_DELETES_RETENTION", "how long deleted tweets and comments are kept before they are purged", &c.Deletes.Retention),
+		durationSetting("deletes-purge-interval", "TWITTER_DELETES_PURGE_INTERVAL", "how often deleted tweets and comments are purged", &c.Deletes.PurgeInterval),
+		stringSetting("log-level", "TWITTER_LOG_LEVEL", "debug, info or error", &c.Log.Level),
+		boolSetting("registration", "TWITTER_REGISTRATION", "allow new accounts", &c.Features.Registration),
+		listSetting("unverified-restrictions", "TWITTER_UNVERIFIED_RESTRICTIONS", "comma separated actions denied to unverified users", &c.Features.UnverifiedRestrictions),
+	}
+}
+
+func stringSetting(name, env, usage string, p *string) setting {
+	return setting{name, env, usage,
+		func() string { return *p },
+		func(value string) error { *p = value; return nil },
+	}
+}
+
+func boolSetting(name, env, usage string, p *bool) setting {
+	return setting{name, env, usage,
+		func() string { return strconv.FormatBool(*p) },
+		func(value string) (err error) { *p, err = strconv.ParseBool(value); return err },
+	}
+}
+
+func intSetting(name, env, usage string, p *int) setting {
+	return setting{name, env, usage,
+		func() string { return strconv.Itoa(*p) },
+		func(value string) (err error) { *p, err = strconv.Atoi(value); return err },
+	}
+}
+
+func int32Setting(name, env, usage string, p *int32) setting {
+	return setting{name, env, usage,
+		func() string { return strconv.FormatInt(int64(*p), 10) },
+		func(value string) error {
+			n, err := strconv.ParseInt(value, 10, 32)
+			*p = int32(n)
+			return err
+		},
+	}
+}
+
+func int64Setting(name, env, usage string, p *int64) setting {
+	return setting{name, env, usage,
+		func() string { return strconv.FormatInt(*p, 10) },
+		func(value string) (err error) { *p, err = strconv.ParseInt(value, 10, 64); return err },
+	}
+}
+
+func uint32Setting(name, env, usage string, p *uint32) setting {
+	return setting{name, env, usage,
+		func() string { return strconv.FormatUint(uint64(*p), 10) },
+		func(value string) error {
+			n, err := strconv.ParseUint(value, 10, 32)
+			*p = uint32(n)
+			return err
+		},
+	}
+}
+
+func uint8Setting(name, env, usage string, p *uint8) setting {
+	return setting{name, env, usage,
+		func() string { return strconv.FormatUint(uint64(*p), 10) },
+		func(value string) error {
+			n, err := strconv.ParseUint(value, 10, 8)
+			*p = uint8(n)
+			return err
+		},
+	}
+}
+
+func durationSetting(name, env, usage string, p *time.Duration) setting {
+	return setting{name, env, usage,
+		func() string { return p.String() },
+		func(value string) (err error) { *p, err = time.ParseDuration(value); return err },
+	}
+}
+
+func listSetting(name, env, usage string, p *[]string) setting {
+	return setting{name, env, usage,
+		func() string { return strings.Join(*p, ",") },
+		func(value string) error {
+			*p = []string{}
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					*p = append(*p, item)
+				}
+			}
+			return nil
+		},
+	}
+}
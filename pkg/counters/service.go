@@ -0,0 +1,210 @@
+package counters
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// DefaultBatchSize is how many rows are locked and recounted at a time.
+const DefaultBatchSize = 1000
+
+// counter is a denormalised count column and the rows it counts. When set,
+// filter is a condition on those rows, named s, and live one on the rows
+// holding the count, named t; the counts of other rows are left alone.
+type counter struct {
+	table  string
+	column string
+	source string
+	key    string
+	filter string
+	live   string
+}
+
+// notDeleted leaves out the tweets and comments waiting to be purged, and
+// live skips the counts of those rows themselves: a deleted tweet or comment
+// keeps the counts it had, so that restoring it with its replies brings them
+// back right.
+const (
+	notDeleted = "s.deleted_at IS NULL"
+	live       = "t.deleted_at IS NULL"
+)
+
+var counters = []counter{
+	{table: "tweets", column: "likes_count", source: "tweet_likes", key: "tweet_id", live: live},
+	{table: "tweets", column: "retweets_count", source: "tweet_retweets", key: "tweet_id", live: live},
+	{table: "tweets", column: "comments_count", source: "comments", key: "tweet_id", filter: notDeleted, live: live},
+	{table: "tweets", column: "quotes_count", source: "tweets", key: "quoted_tweet_id", filter: notDeleted, live: live},
+	{table: "comments", column: "likes_count", source: "comment_likes", key: "comment_id", live: live},
+	{table: "comments", column: "replies_count", source: "comments", key: "parent_id", filter: notDeleted, live: live},
+	{table: "users", column: "followers_count", source: "follows", key: "followee_id"},
+	{table: "users", column: "followees_count", source: "follows", key: "follower_id"},
+}
+
+// Discrepancy is a counter whose stored value did not match its rows.
+type Discrepancy struct {
+	Table  string `json:"table"`
+	Column string `json:"column"`
+	ID     int64  `json:"id"`
+	Stored int64  `json:"stored"`
+	Actual int64  `json:"actual"`
+}
+
+func (d Discrepancy) String() string {
+	return fmt.Sprintf("%s.%s id=%d stored=%d actual=%d", d.Table, d.Column, d.ID, d.Stored, d.Actual)
+}
+
+type Report struct {
+	Checked       int64         `json:"checked"`
+	Discrepancies []Discrepancy `json:"discrepancies"`
+	Fixed         bool          `json:"fixed"`
+}
+
+type Service struct {
+	pool      *pgxpool.Pool
+	batchSize int
+}
+
+func NewService(pool *pgxpool.Pool) *Service {
+	return &Service{pool: pool, batchSize: DefaultBatchSize}
+}
+
+func (s *Service) SetBatchSize(size int) {
+	s.batchSize = size
+}
+
+// Reconcile recounts every counter from the rows it counts and, when fix is
+// set, stores the recounted values. Rows are handled in batches, each in a
+// short transaction that locks only that batch, the same row locks the
+// like, retweet and follow operations take.
+func (s *Service) Reconcile(ctx context.Context, fix bool) (Report, error) {
+	report := Report{Discrepancies: make([]Discrepancy, 0), Fixed: fix}
+
+	for _, c := range counters {
+		var after int64
+		for {
+			last, checked, found, err := s.reconcileBatch(ctx, c, after, fix)
+			if err != nil {
+				return report, err
+			}
+			report.Checked += checked
+			report.Discrepancies = append(report.Discrepancies, found...)
+			if checked < int64(s.batchSize) {
+				break
+			}
+			after = last
+		}
+	}
+
+	return report, nil
+}
+
+// reconcileBatch handles the rows of c.table with ids after the given one
+// and returns the last id it saw.
+func (s *Service) reconcileBatch(ctx context.Context, c counter, after int64, fix bool) (last int64, checked int64, found []Discrepancy, err error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("Error begin reconcile: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	ids := make([]int64, 0, s.batchSize)
+	rows, err := tx.Query(ctx, fmt.Sprintf(`SELECT id FROM %s WHERE id > $1 ORDER BY id LIMIT $2 FOR UPDATE`, c.table), after, s.batchSize)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("Error lock %s: %w", c.table, err)
+	}
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, 0, nil, fmt.Errorf("Error scan %s id: %w", c.table, err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, 0, nil, fmt.Errorf("Error iterate %s rows: %w", c.table, err)
+	}
+	if len(ids) == 0 {
+		return after, 0, nil, nil
+	}
+
+	// Rows that are not live stay locked and checked, so that batches keep
+	// their size, but are not recounted.
+	filter, live := "TRUE", "TRUE"
+	if c.filter != "" {
+		filter = c.filter
+	}
+	if c.live != "" {
+		live = c.live
+	}
+	recount := fmt.Sprintf(`
+		SELECT t.id, t.%[2]s, (SELECT count(*) FROM %[3]s s WHERE s.%[4]s = t.id AND %[5]s) AS actual
+		FROM %[1]s t WHERE t.id = ANY($1) AND %[6]s`, c.table, c.column, c.source, c.key, filter, live)
+	query := `WITH recount AS (` + recount + `) SELECT id, ` + c.column + `, actual FROM recount WHERE ` + c.column + ` <> actual ORDER BY id`
+	if fix {
+		query = fmt.Sprintf(`
+		WITH recount AS (%[3]s)
+		UPDATE %[1]s t SET %[2]s = recount.actual FROM recount
+		WHERE t.id = recount.id AND recount.%[2]s <> recount.actual
+		RETURNING t.id, recount.%[2]s, recount.actual`, c.table, c.column, recount)
+	}
+
+	found, err = scanDiscrepancies(ctx, tx, c, query, ids)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return 0, 0, nil, fmt.Errorf("Error commit reconcile: %w", err)
+	}
+
+	return ids[len(ids)-1], int64(len(ids)), found, nil
+}
+
+func scanDiscrepancies(ctx context.Context, tx pgx.Tx, c counter, query string, ids []int64) ([]Discrepancy, error) {
+	rows, err := tx.Query(ctx, query, ids)
+	if err != nil {
+		return nil, fmt.Errorf("Error recount %s.%s: %w", c.table, c.column, err)
+	}
+	defer rows.Close()
+
+	found := make([]Discrepancy, 0)
+	for rows.Next() {
+		d := Discrepancy{Table: c.table, Column: c.column}
+		if err = rows.Scan(&d.ID, &d.Stored, &d.Actual); err != nil {
+			return nil, fmt.Errorf("Error scan recount: %w", err)
+		}
+		found = append(found, d)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error iterate recount rows: %w", err)
+	}
+	return found, nil
+}
+
+// StartReconciler fixes drifted counters every interval until ctx is done
+// and logs what it corrected.
+func (s *Service) StartReconciler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, err := s.Reconcile(ctx, true)
+			if err != nil && ctx.Err() == nil {
+				log.Println(err)
+			}
+			for _, d := range report.Discrepancies {
+				log.Printf("Counter reconciler fixed %s", d)
+			}
+		}
+	}
+}
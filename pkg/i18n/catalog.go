@@ -0,0 +1,193 @@
+package i18n
+
+// catalog holds every user-facing text by language and key. Error keys are
+// the codes of apperr errors, validation reasons are prefixed with "field."
+// and notification texts with "mail.".
+var catalog = map[string]map[string]string{
+	English: {
+		"bad_request":             "Bad request",
+		"invalid_body":            "Request body is not valid JSON",
+		"invalid_argument":        "Invalid argument",
+		"validation_failed":       "Some fields are invalid",
+		"unauthorized":            "Not authorized",
+		"forbidden":               "Forbidden",
+		"not_found":               "Not found",
+		"method_not_allowed":      "Method not allowed",
+		"conflict":                "Conflict with the current state",
+		"internal":                "Internal error",
+		"too_large":               "Request body is too large",
+		"registration_disabled":   "Registration is disabled",
+		"cannot_follow_self":      "You cannot follow yourself",
+		"invalid_credentials":     "Invalid email or password",
+		"session_not_found":       "Session not found",
+		"user_not_found":          "User not found",
+		"email_taken":             "Email is already taken",
+		"username_taken":          "Username is already taken",
+		"refresh_token_reused":    "Refresh token was already used, the session has been revoked",
+		"two_factor_enabled":      "Two-factor authentication is already enabled",
+		"two_factor_not_enrolled": "Two-factor authentication is not set up",
+		"invalid_two_factor_code": "Invalid two-factor code",
+		"invalid_challenge":       "Login challenge is invalid or expired",
+		"too_many_attempts":       "Too many attempts, try again later",
+		"invalid_action_token":    "Token is invalid, used or expired",
+		"email_not_verified":      "Email is not verified",
+		"email_already_verified":  "Email is already verified",
+		"tweet_not_found":         "Tweet not found",
+		"not_tweet_owner":         "The tweet belongs to another user",
+		"cannot_retweet_own":      "You cannot retweet your own tweet",
+		"edit_window_closed":      "The time to edit has run out",
+		"edit_limit_reached":      "No more edits are allowed",
+		"undo_window_closed":      "The time to undo the deletion has run out",
+		"comment_not_found":       "Comment not found",
+		"not_comment_owner":       "The comment belongs to another user",
+		"comment_too_deep":        "Replies cannot be nested this deep",
+		"comment_parent_mismatch": "The comment you reply to belongs to another tweet",
+
+		"field.required":                  "is required",
+		"field.invalid_email":             "is not a valid email address",
+		"field.username_length":           "must be 3 to 30 characters long",
+		"field.username_charset":          "may contain only latin letters, digits and underscores",
+		"field.password_length":           "must be 8 to 128 characters long",
+		"field.password_weak":             "must contain letters and digits",
+		"field.password_breached":         "appears in a list of breached passwords",
+		"field.cannot_be_removed":         "cannot be removed",
+		"field.must_be_string":            "must be a string",
+		"field.unknown_field":             "unknown field",
+		"field.current_password_required": "is required to change email or password",
+		"field.unsupported_locale":        "unsupported language",
+		"field.invalid_limit":             "must be a number from 1 to 100",
+		"field.invalid_cursor":            "invalid cursor",
+		"field.invalid_depth":             "must be a number from 1 to 10",
+		"field.invalid_sort":              "must be newest, oldest or most_liked",
+		"field.invalid_id":                "must be a number",
+
+		"mail.reset.subject":  "Password reset",
+		"mail.reset.body":     "Use this token to set a new password within an hour:\n\n%s\n",
+		"mail.verify.subject": "Confirm your email",
+		"mail.verify.body":    "Use this token to confirm your email address:\n\n%s\n",
+	},
+	Russian: {
+		"bad_request":             "Некорректный запрос",
+		"invalid_body":            "Тело запроса не является корректным JSON",
+		"invalid_argument":        "Недопустимое значение параметра",
+		"validation_failed":       "Некоторые поля заполнены неверно",
+		"unauthorized":            "Не авторизован",
+		"forbidden":               "Доступ запрещён",
+		"not_found":               "Не найдено",
+		"method_not_allowed":      "Метод не поддерживается",
+		"conflict":                "Конфликт с текущим состоянием",
+		"internal":                "Внутренняя ошибка",
+		"too_large":               "Слишком большой запрос",
+		"registration_disabled":   "Регистрация отключена",
+		"cannot_follow_self":      "Нельзя подписаться на самого себя",
+		"invalid_credentials":     "Неверный email или пароль",
+		"session_not_found":       "Сессия не найдена",
+		"user_not_found":          "Пользователь не найден",
+		"email_taken":             "Этот email уже занят",
+		"username_taken":          "Это имя пользователя уже занято",
+		"refresh_token_reused":    "Refresh-токен уже использован, сессия завершена",
+		"two_factor_enabled":      "Двухфакторная аутентификация уже включена",
+		"two_factor_not_enrolled": "Двухфакторная аутентификация не настроена",
+		"invalid_two_factor_code": "Неверный код подтверждения",
+		"invalid_challenge":       "Запрос на вход недействителен или истёк",
+		"too_many_attempts":       "Слишком много попыток, попробуйте позже",
+		"invalid_action_token":    "Токен недействителен, уже использован или истёк",
+		"email_not_verified":      "Email не подтверждён",
+		"email_already_verified":  "Email уже подтверждён",
+		"tweet_not_found":         "Твит не найден",
+		"not_tweet_owner":         "Твит принадлежит другому пользователю",
+		"cannot_retweet_own":      "Нельзя ретвитнуть собственный твит",
+		"edit_window_closed":      "Время для редактирования истекло",
+		"edit_limit_reached":      "Больше редактировать нельзя",
+		"undo_window_closed":      "Время для отмены удаления истекло",
+		"comment_not_found":       "Комментарий не найден",
+		"not_comment_owner":       "Комментарий принадлежит другому пользователю",
+		"comment_too_deep":        "Ответы не могут быть вложены так глубоко",
+		"comment_parent_mismatch": "Комментарий, на который вы отвечаете, относится к другому твиту",
+
+		"field.required":                  "обязательное поле",
+		"field.invalid_email":             "некорректный адрес email",
+		"field.username_length":           "должно содержать от 3 до 30 символов",
+		"field.username_charset":          "может содержать только латинские буквы, цифры и подчёркивание",
+		"field.password_length":           "должен содержать от 8 до 128 символов",
+		"field.password_weak":             "должен содержать буквы и цифры",
+		"field.password_breached":         "найден в списке утёкших паролей",
+		"field.cannot_be_removed":         "нельзя удалить",
+		"field.must_be_string":            "должно быть строкой",
+		"field.unknown_field":             "неизвестное поле",
+		"field.current_password_required": "требуется для смены email или пароля",
+		"field.unsupported_locale":        "язык не поддерживается",
+		"field.invalid_limit":             "должно быть числом от 1 до 100",
+		"field.invalid_cursor":            "неверный курсор",
+		"field.invalid_depth":             "должно быть числом от 1 до 10",
+		"field.invalid_sort":              "должно быть newest, oldest или most_liked",
+		"field.invalid_id":                "должно быть числом",
+
+		"mail.reset.subject":  "Сброс пароля",
+		"mail.reset.body":     "Используйте этот токен, чтобы задать новый пароль в течение часа:\n\n%s\n",
+		"mail.verify.subject": "Подтвердите email",
+		"mail.verify.body":    "Используйте этот токен, чтобы подтвердить адрес email:\n\n%s\n",
+	},
+	Tajik: {
+		"bad_request":             "Дархости нодуруст",
+		"invalid_body":            "Матни дархост JSON-и дуруст нест",
+		"invalid_argument":        "Қимати параметр нодуруст аст",
+		"validation_failed":       "Баъзе майдонҳо нодуруст пур карда шудаанд",
+		"unauthorized":            "Шумо ворид нашудаед",
+		"forbidden":               "Дастрасӣ манъ аст",
+		"not_found":               "Ёфт нашуд",
+		"method_not_allowed":      "Ин усул дастгирӣ намешавад",
+		"conflict":                "Бо ҳолати ҷорӣ мухолиф аст",
+		"internal":                "Хатои дохилӣ",
+		"too_large":               "Ҳаҷми дархост аз ҳад зиёд аст",
+		"registration_disabled":   "Бақайдгирӣ ғайрифаъол аст",
+		"cannot_follow_self":      "Ба худатон обуна шудан мумкин нест",
+		"invalid_credentials":     "Email ё рамз нодуруст аст",
+		"session_not_found":       "Сессия ёфт нашуд",
+		"user_not_found":          "Корбар ёфт нашуд",
+		"email_taken":             "Ин email аллакай банд аст",
+		"username_taken":          "Ин номи корбар аллакай банд аст",
+		"refresh_token_reused":    "Refresh-токен аллакай истифода шудааст, сессия қатъ карда шуд",
+		"two_factor_enabled":      "Аутентификатсияи дуомила аллакай фаъол аст",
+		"two_factor_not_enrolled": "Аутентификатсияи дуомила танзим нашудааст",
+		"invalid_two_factor_code": "Рамзи тасдиқ нодуруст аст",
+		"invalid_challenge":       "Дархости воридшавӣ нодуруст аст ё мӯҳлаташ гузаштааст",
+		"too_many_attempts":       "Кӯшишҳо аз ҳад зиёданд, баъдтар боз кӯшиш кунед",
+		"invalid_action_token":    "Токен нодуруст, истифодашуда ё мӯҳлаташ гузаштааст",
+		"email_not_verified":      "Email тасдиқ нашудааст",
+		"email_already_verified":  "Email аллакай тасдиқ шудааст",
+		"tweet_not_found":         "Твит ёфт нашуд",
+		"not_tweet_owner":         "Твит ба корбари дигар тааллуқ дорад",
+		"cannot_retweet_own":      "Твити худро ретвит кардан мумкин нест",
+		"edit_window_closed":      "Вақти таҳрир гузашт",
+		"edit_limit_reached":      "Дигар таҳрир кардан мумкин нест",
+		"undo_window_closed":      "Вақти бекор кардани нест кардан гузашт",
+		"comment_not_found":       "Шарҳ ёфт нашуд",
+		"not_comment_owner":       "Шарҳ ба корбари дигар тааллуқ дорад",
+		"comment_too_deep":        "Ҷавобҳо наметавонанд ин қадар чуқур бошанд",
+		"comment_parent_mismatch": "Шарҳе, ки ба он ҷавоб медиҳед, ба твити дигар тааллуқ дорад",
+
+		"field.required":                  "майдони ҳатмӣ",
+		"field.invalid_email":             "суроғаи email нодуруст аст",
+		"field.username_length":           "бояд аз 3 то 30 аломат дошта бошад",
+		"field.username_charset":          "танҳо ҳарфҳои лотинӣ, рақамҳо ва зерхат иҷозат дода мешаванд",
+		"field.password_length":           "бояд аз 8 то 128 аломат дошта бошад",
+		"field.password_weak":             "бояд ҳарф ва рақам дошта бошад",
+		"field.password_breached":         "дар рӯйхати рамзҳои ошкоргардида мавҷуд аст",
+		"field.cannot_be_removed":         "нест кардан мумкин нест",
+		"field.must_be_string":            "бояд сатр бошад",
+		"field.unknown_field":             "майдони номаълум",
+		"field.current_password_required": "барои иваз кардани email ё рамз лозим аст",
+		"field.unsupported_locale":        "забон дастгирӣ намешавад",
+		"field.invalid_limit":             "бояд адад аз 1 то 100 бошад",
+		"field.invalid_cursor":            "курсори нодуруст",
+		"field.invalid_depth":             "бояд адад аз 1 то 10 бошад",
+		"field.invalid_sort":              "бояд newest, oldest ё most_liked бошад",
+		"field.invalid_id":                "бояд адад бошад",
+
+		"mail.reset.subject":  "Барқароркунии рамз",
+		"mail.reset.body":     "Барои дар давоми як соат гузоштани рамзи нав ин токенро истифода баред:\n\n%s\n",
+		"mail.verify.subject": "Email-и худро тасдиқ кунед",
+		"mail.verify.body":    "Барои тасдиқи суроғаи email ин токенро истифода баред:\n\n%s\n",
+	},
+}
@@ -0,0 +1,91 @@
+package i18n
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	Russian = "ru"
+	English = "en"
+	Tajik   = "tg"
+)
+
+// Default is used when neither the user nor the request asks for a
+// supported language.
+const Default = Russian
+
+// Supported reports whether lang has a catalogue.
+func Supported(lang string) bool {
+	_, ok := catalog[lang]
+	return ok
+}
+
+// Match picks the supported language preferred by an Accept-Language
+// header value, or Default when there is none.
+func Match(acceptLanguage string) string {
+	type candidate struct {
+		lang string
+		q    float64
+	}
+
+	candidates := make([]candidate, 0)
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if tag == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if value, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = value
+				}
+			}
+		}
+
+		if tag == "*" {
+			tag = Default
+		}
+		if base := strings.SplitN(tag, "-", 2)[0]; q > 0 && Supported(base) {
+			candidates = append(candidates, candidate{lang: base, q: q})
+		}
+	}
+
+	if len(candidates) == 0 {
+		return Default
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].q > candidates[j].q
+	})
+	return candidates[0].lang
+}
+
+// Lookup returns the message key translated to lang, falling back to
+// English.
+func Lookup(lang string, key string) (string, bool) {
+	if message, ok := catalog[lang][key]; ok {
+		return message, true
+	}
+	message, ok := catalog[English][key]
+	return message, ok
+}
+
+// T translates key to lang and formats it with args. Unknown keys are
+// returned as is.
+func T(lang string, key string, args ...interface{}) string {
+	message, ok := Lookup(lang, key)
+	if !ok {
+		return key
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(message, args...)
+	}
+	return message
+}
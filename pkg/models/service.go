@@ -1,6 +1,11 @@
 package models
 
-import "time"
+import (
+	"net/url"
+	"time"
+
+	"github.com/me0888/twitter/pkg/pagination"
+)
 
 type UserInput struct {
 	Email    string `json:"email"`
@@ -9,23 +14,178 @@ type UserInput struct {
 	//Avatar   string `json:"avatar"`
 }
 
+// Principal is the authenticated caller of a request: the user, the session
+// their token belongs to, what the session may do and what the user is.
+type Principal struct {
+	UserID    int64
+	SessionID int64
+	Scopes    []string
+	Roles     []string
+	Locale    string
+}
+
+func (p Principal) HasScope(scope string) bool {
+	return contains(p.Scopes, scope)
+}
+
+func (p Principal) HasRole(role string) bool {
+	return contains(p.Roles, role)
+}
+
+func contains(list []string, item string) bool {
+	for _, value := range list {
+		if value == item {
+			return true
+		}
+	}
+	return false
+}
+
+// UserPatch holds the profile fields sent in a PATCH /user merge patch. A nil
+// field is left unchanged.
+type UserPatch struct {
+	Email           *string `json:"email"`
+	Username        *string `json:"username"`
+	Password        *string `json:"password"`
+	Locale          *string `json:"locale"`
+	CurrentPassword string  `json:"current_password"`
+}
+
+// Tweet.Author and the *ByMe and IsMine flags describe the tweet as seen
+// by the user who asked for it.
 type Tweet struct {
-	ID            int64     `json:"id"`
-	UserID        int64     `json:"-"`
-	Content       string    `json:"content"`
-	LikesCount    int       `json:"likes_count"`
-	CommentsCount int       `json:"comments_count"`
-	RetweetsCount int       `json:"retweets_count"`
-	CreatedAt     time.Time `json:"created_at"`
-	UpdatedAt     time.Time `json:"updated_at"`
+	ID               int64        `json:"id"`
+	UserID           int64        `json:"-"`
+	Author           *UserRef     `json:"author,omitempty"`
+	Content          string       `json:"content"`
+	InReplyToTweetID *int64       `json:"in_reply_to_tweet_id"`
+	ConversationID   int64        `json:"conversation_id"`
+	QuotedTweetID    *int64       `json:"quoted_tweet_id"`
+	QuotedTweet      *QuotedTweet `json:"quoted_tweet,omitempty"`
+	LikesCount       int          `json:"likes_count"`
+	CommentsCount    int          `json:"comments_count"`
+	RetweetsCount    int          `json:"retweets_count"`
+	QuotesCount      int          `json:"quotes_count"`
+	LikedByMe        bool         `json:"liked_by_me"`
+	RetweetedByMe    bool         `json:"retweeted_by_me"`
+	IsMine           bool         `json:"is_mine"`
+	Edited           bool         `json:"edited"`
+	CreatedAt        time.Time    `json:"created_at"`
+	UpdatedAt        time.Time    `json:"updated_at"`
+	DeletedAt        *time.Time   `json:"deleted_at,omitempty"`
+}
+
+// QuoteDeleted is the Unavailable reason of a quoted tweet that is gone.
+const QuoteDeleted = "deleted"
+
+// QuotedTweet is the tweet a quote embeds. Tweet is nil when it can not be
+// shown, and Unavailable then says why. The quoted tweet's own quote is not
+// embedded any further.
+type QuotedTweet struct {
+	ID          int64  `json:"id"`
+	Tweet       *Tweet `json:"tweet"`
+	Unavailable string `json:"unavailable,omitempty"`
 }
 
+// TimelineItem is a tweet in the home timeline. RetweetedBy is set when the
+// tweet is there because a followed user retweeted it, and At is when the
+// tweet was posted or that retweet made.
+type TimelineItem struct {
+	Tweet
+	RetweetedBy *UserRef  `json:"retweeted_by"`
+	At          time.Time `json:"timeline_at"`
+}
+
+// Conversation is a tweet with the tweets it answers, the thread's first
+// tweet first, and a page of the replies it got.
+type Conversation struct {
+	Ancestors []Tweet         `json:"ancestors"`
+	Tweet     Tweet           `json:"tweet"`
+	Replies   pagination.Page `json:"replies"`
+}
+
+// ReplyNode is a reply with the first of its own replies. MoreReplies is set
+// when it has replies that are not shown; they are read from its own
+// conversation.
+type ReplyNode struct {
+	Tweet
+	Replies     []ReplyNode `json:"replies"`
+	MoreReplies bool        `json:"more_replies"`
+}
+
+// UserRef names a user inside another object.
+type UserRef struct {
+	ID        int64  `json:"id"`
+	UserName  string `json:"username"`
+	AvatarURL string `json:"avatar_url"`
+}
+
+// NewUserRef builds the reference to a user from their stored avatar path.
+func NewUserRef(id int64, username string, avatar string) *UserRef {
+	return &UserRef{ID: id, UserName: username, AvatarURL: AvatarURL(username, avatar)}
+}
+
+// AvatarURL is the path the avatar of username is served at, or "" when
+// they have not uploaded one.
+func AvatarURL(username string, avatar string) string {
+	if avatar == "" {
+		return ""
+	}
+	return "/users/" + url.PathEscape(username) + "/avatar"
+}
+
+// Comment.Author, LikedByMe and IsMine work like those of Tweet.
 type Comment struct {
-	ID         int64     `json:"id"`
-	Content    string    `json:"content"`
-	LikesCount int       `json:"likes_count"`
-	CreatedAt  time.Time `json:"created_at"`
-	UpdatedAt  time.Time `json:"updated_at"`
+	ID           int64      `json:"id"`
+	UserID       int64      `json:"-"`
+	Author       *UserRef   `json:"author,omitempty"`
+	TweetID      int64      `json:"tweet_id"`
+	ParentID     *int64     `json:"parent_id"`
+	Content      string     `json:"content"`
+	LikesCount   int        `json:"likes_count"`
+	RepliesCount int        `json:"replies_count"`
+	LikedByMe    bool       `json:"liked_by_me"`
+	IsMine       bool       `json:"is_mine"`
+	Edited       bool       `json:"edited"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+	DeletedAt    *time.Time `json:"deleted_at,omitempty"`
+}
+
+// Revision is an earlier version of an edited tweet or comment: the content
+// it had and when that content was written.
+type Revision struct {
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TweetHistory is a tweet as it is now with its earlier versions, oldest
+// first.
+type TweetHistory struct {
+	Tweet     Tweet      `json:"tweet"`
+	Revisions []Revision `json:"revisions"`
+}
+
+// CommentHistory is a comment as it is now with its earlier versions,
+// oldest first.
+type CommentHistory struct {
+	Comment   Comment    `json:"comment"`
+	Revisions []Revision `json:"revisions"`
+}
+
+// CommentNode is a reply to a comment with the first of its own replies.
+// MoreCursor is set when it has replies that are not shown; it reads the
+// rest from its replies.
+type CommentNode struct {
+	Comment
+	Replies    []CommentNode `json:"replies"`
+	MoreCursor *string       `json:"more_cursor"`
+}
+
+// CommentThread is a comment with a page of the replies under it.
+type CommentThread struct {
+	Comment Comment         `json:"comment"`
+	Replies pagination.Page `json:"replies"`
 }
 
 type UserProfile struct {
@@ -33,11 +193,13 @@ type UserProfile struct {
 	Email          string `json:"email"`
 	UserName       string `json:"username"`
 	Avatar         string `json:"avatar"`
+	Locale         string `json:"locale"`
 	FollowersCount int64  `json:"followers_count"`
 	FolloweesCount int64  `json:"followees_count"`
 }
 
 type User_resp struct {
+	ID       int64  `json:"id"`
 	Email    string `json:"email"`
 	Username string `json:"username"`
 }
@@ -63,13 +225,66 @@ type LoginInput struct {
 }
 
 type LoginOutput struct {
+	Token        string     `json:"token,omitempty"`
+	RefreshToken string     `json:"refresh_token,omitempty"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	Challenge    string     `json:"challenge,omitempty"`
+}
+
+type ForgotPasswordInput struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordInput struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type VerifyEmailInput struct {
 	Token string `json:"token"`
 }
 
+type LoginChallengeInput struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+type TOTPEnrollment struct {
+	Secret        string   `json:"secret"`
+	URI           string   `json:"uri"`
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type TOTPCodeInput struct {
+	Code string `json:"code"`
+}
+
+type RefreshInput struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type Session struct {
+	ID        int64     `json:"id"`
+	Created   time.Time `json:"created"`
+	Expire    time.Time `json:"expire"`
+	LastSeen  time.Time `json:"last_seen"`
+	UserAgent string    `json:"user_agent"`
+	Current   bool      `json:"current"`
+}
+
+type RevokeResponse struct {
+	Revoked int64 `json:"revoked"`
+}
+
+// CreatePostInput.InReplyToTweetID makes the tweet a reply and
+// QuotedTweetID a quote of another tweet.
 type CreatePostInput struct {
-	Content string `json:"content"`
+	Content          string `json:"content"`
+	InReplyToTweetID *int64 `json:"in_reply_to_tweet_id"`
+	QuotedTweetID    *int64 `json:"quoted_tweet_id"`
 }
 
 type CreateCommentInput struct {
-	Content string `json:"content"`
+	Content  string `json:"content"`
+	ParentID *int64 `json:"parent_id"`
 }
@@ -0,0 +1,169 @@
+package pagination
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/me0888/twitter/pkg/apperr"
+)
+
+const (
+	DefaultLimit = 20
+	MaxLimit     = 100
+)
+
+// Cursor marks a position in a keyset ordering: the sort key of a row, its
+// id as a tie breaker and the direction to read in from there.
+type Cursor struct {
+	Key      string `json:"k"`
+	ID       int64  `json:"i"`
+	Backward bool   `json:"b,omitempty"`
+}
+
+// Encode returns the opaque form of the cursor handed to clients.
+func (c Cursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decode(value string) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var cursor Cursor
+	if err = json.Unmarshal(data, &cursor); err != nil {
+		return nil, err
+	}
+	return &cursor, nil
+}
+
+// TimeCursor positions a cursor on a row ordered by a timestamp column.
+func TimeCursor(t time.Time, id int64) Cursor {
+	return Cursor{Key: t.Format(time.RFC3339Nano), ID: id}
+}
+
+// Query is a page request. A nil Cursor asks for the first page.
+type Query struct {
+	Limit  int
+	Cursor *Cursor
+}
+
+// Parse reads the limit and cursor query parameters.
+func Parse(values url.Values) (Query, error) {
+	q := Query{Limit: DefaultLimit}
+	errs := apperr.FieldErrors{}
+
+	if value := values.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > MaxLimit {
+			errs["limit"] = "invalid_limit"
+		}
+		q.Limit = limit
+	}
+
+	if value := values.Get("cursor"); value != "" {
+		cursor, err := decode(value)
+		if err != nil {
+			errs["cursor"] = "invalid_cursor"
+		}
+		q.Cursor = cursor
+	}
+
+	if len(errs) > 0 {
+		return q, errs
+	}
+	return q, nil
+}
+
+// fetch is the number of rows to select: one more than the limit, which
+// tells whether another page follows.
+func (q Query) fetch() int {
+	return q.Limit + 1
+}
+
+func (q Query) backward() bool {
+	return q.Cursor != nil && q.Cursor.Backward
+}
+
+// Keyset orders rows by Key, then by the unique ID column. Type is the SQL
+// type the key is compared as.
+type Keyset struct {
+	Key  string
+	ID   string
+	Type string
+	Desc bool
+}
+
+// Clause returns the condition selecting the rows past the cursor of q and
+// the ORDER BY and LIMIT that follow it, with their arguments numbered from
+// $n. Pages read backward are selected in reverse; Page puts them back. The
+// cursor key is cast to Type by the database, which rejects a key that does
+// not fit as an invalid value.
+func (k Keyset) Clause(q Query, n int) (where string, tail string, args []interface{}) {
+	direction, compare := "ASC", ">"
+	if k.Desc != q.backward() {
+		direction, compare = "DESC", "<"
+	}
+	tail = fmt.Sprintf("ORDER BY %s %s, %s %s LIMIT $%d", k.Key, direction, k.ID, direction, n)
+	args = []interface{}{q.fetch()}
+
+	if q.Cursor == nil {
+		return "TRUE", tail, args
+	}
+
+	where = fmt.Sprintf("(%s, %s) %s ($%d::%s, $%d)", k.Key, k.ID, compare, n+1, k.Type, n+2)
+	return where, tail, append(args, q.Cursor.Key, q.Cursor.ID)
+}
+
+// Page is the envelope of a list response.
+type Page struct {
+	Items      interface{} `json:"items"`
+	NextCursor *string     `json:"next_cursor"`
+	PrevCursor *string     `json:"prev_cursor"`
+}
+
+// Page builds the envelope from the rows selected with Clause. items must be
+// a slice; key returns the cursor position of its i-th item and is called
+// once the items are in page order, so it may index the slice passed in.
+func (q Query) Page(items interface{}, key func(i int) Cursor) Page {
+	value := reflect.ValueOf(items)
+	more := value.Len() > q.Limit
+	if more {
+		value = value.Slice(0, q.Limit)
+	}
+
+	backward := q.backward()
+	if backward {
+		swap := reflect.Swapper(value.Interface())
+		for i, j := 0, value.Len()-1; i < j; i, j = i+1, j-1 {
+			swap(i, j)
+		}
+	}
+
+	page := Page{Items: value.Interface()}
+	if value.Len() == 0 {
+		return page
+	}
+
+	// Once reversed, a backward page was cut off before its first item, a
+	// forward page after its last one.
+	first, last := key(0), key(value.Len()-1)
+
+	if more || backward {
+		next := Cursor{Key: last.Key, ID: last.ID}.Encode()
+		page.NextCursor = &next
+	}
+	if backward && more || !backward && q.Cursor != nil {
+		first.Backward = true
+		prev := first.Encode()
+		page.PrevCursor = &prev
+	}
+	return page
+}
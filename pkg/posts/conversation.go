@@ -0,0 +1,187 @@
+package posts
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/me0888/twitter/pkg/models"
+	"github.com/me0888/twitter/pkg/pagination"
+)
+
+// The depth of a reply tree is how many levels of replies it shows, the
+// direct replies being the first. GetConversation and the replies of a
+// comment take it within these limits.
+const (
+	DefaultReplyDepth = 3
+	MaxReplyDepth     = 10
+)
+
+// nestedReplies is how many replies are shown under a reply below the first
+// level.
+const nestedReplies = 3
+
+// Replies are listed oldest first, so that a thread reads top down.
+var replyKeys = pagination.Keyset{Key: "tweets.created_at", ID: "tweets.id", Type: "timestamptz"}
+
+// GetConversation returns tweetID with every tweet up the chain it replies
+// to and a page of its direct replies. Below them the replies of replies are
+// shown, a few per reply, until the tree is depth levels deep.
+func (s *Service) GetConversation(ctx context.Context, viewerID int64, tweetID string, depth int, page pagination.Query) (models.Conversation, error) {
+	var conversation models.Conversation
+
+	tweet, err := s.tweet(ctx, tweetID)
+	if err != nil {
+		return conversation, err
+	}
+	conversation.Tweet = tweet
+
+	conversation.Ancestors, err = s.ancestors(ctx, tweet.ID)
+	if err != nil {
+		return conversation, err
+	}
+
+	where, tail, args := replyKeys.Clause(page, 2)
+	rows, err := s.pool.Query(ctx, `
+		SELECT `+tweetColumns+`
+		FROM tweets
+		WHERE in_reply_to_tweet_id = $1 AND deleted_at IS NULL
+		AND `+where+` `+tail, append([]interface{}{tweet.ID}, args...)...)
+	if err != nil {
+		return conversation, fmt.Errorf("Error query replies: %w", err)
+	}
+	defer rows.Close()
+
+	nodes := make([]models.ReplyNode, 0)
+	for rows.Next() {
+		node := models.ReplyNode{Replies: make([]models.ReplyNode, 0)}
+		if err = rows.Scan(tweetFields(&node.Tweet)...); err != nil {
+			return conversation, fmt.Errorf("Error scan reply: %w", err)
+		}
+		nodes = append(nodes, node)
+	}
+	if err = rows.Err(); err != nil {
+		return conversation, fmt.Errorf("Error iterate reply rows: %w", err)
+	}
+
+	conversation.Replies = page.Page(nodes, func(i int) pagination.Cursor {
+		return pagination.TimeCursor(nodes[i].CreatedAt, nodes[i].ID)
+	})
+	nodes = conversation.Replies.Items.([]models.ReplyNode)
+
+	level := make([]*models.ReplyNode, len(nodes))
+	for i := range nodes {
+		level[i] = &nodes[i]
+	}
+	// Each query attaches the next level; the one past depth only tells which
+	// replies have more below them.
+	for d := 2; d <= depth+1 && len(level) > 0; d++ {
+		if level, err = s.nestedReplies(ctx, level, d <= depth); err != nil {
+			return conversation, err
+		}
+	}
+
+	tweets := []*models.Tweet{&conversation.Tweet}
+	for i := range conversation.Ancestors {
+		tweets = append(tweets, &conversation.Ancestors[i])
+	}
+	tweets = appendReplyTweets(tweets, nodes)
+	if err = s.fill(ctx, viewerID, tweets); err != nil {
+		return conversation, err
+	}
+
+	return conversation, nil
+}
+
+// ancestors returns the tweets tweetID replies to, directly or not, oldest
+// first. Deleted ones are left out.
+func (s *Service) ancestors(ctx context.Context, tweetID int64) ([]models.Tweet, error) {
+	rows, err := s.pool.Query(ctx, `
+		WITH RECURSIVE ancestors AS (
+			SELECT in_reply_to_tweet_id AS id, 1 AS depth FROM tweets WHERE id = $1
+			UNION ALL
+			SELECT tweets.in_reply_to_tweet_id, ancestors.depth + 1
+			FROM ancestors JOIN tweets ON tweets.id = ancestors.id
+		)
+		SELECT `+tweetColumns+`
+		FROM ancestors JOIN tweets ON tweets.id = ancestors.id
+		WHERE tweets.deleted_at IS NULL
+		ORDER BY ancestors.depth DESC`, tweetID)
+	if err != nil {
+		return nil, fmt.Errorf("Error query ancestors: %w", err)
+	}
+	defer rows.Close()
+
+	tt := make([]models.Tweet, 0)
+	for rows.Next() {
+		var t models.Tweet
+		if err = rows.Scan(tweetFields(&t)...); err != nil {
+			return nil, fmt.Errorf("Error scan ancestor: %w", err)
+		}
+		tt = append(tt, t)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error iterate ancestor rows: %w", err)
+	}
+	return tt, nil
+}
+
+// nestedReplies marks which of parents have replies and, when attach is
+// set, gives each its first replies. It returns the replies attached.
+func (s *Service) nestedReplies(ctx context.Context, parents []*models.ReplyNode, attach bool) ([]*models.ReplyNode, error) {
+	ids := make([]int64, len(parents))
+	byID := make(map[int64]*models.ReplyNode, len(parents))
+	for i, parent := range parents {
+		ids[i] = parent.ID
+		byID[parent.ID] = parent
+	}
+
+	limit := nestedReplies
+	if !attach {
+		limit = 0
+	}
+	rows, err := s.pool.Query(ctx, `
+		SELECT `+tweetColumns+`
+		FROM (
+			SELECT id, row_number() OVER (PARTITION BY in_reply_to_tweet_id ORDER BY created_at, id) AS n
+			FROM tweets WHERE in_reply_to_tweet_id = ANY($1) AND deleted_at IS NULL
+		) ranked
+		JOIN tweets ON tweets.id = ranked.id
+		WHERE ranked.n <= $2
+		ORDER BY tweets.created_at, tweets.id`, ids, limit+1)
+	if err != nil {
+		return nil, fmt.Errorf("Error query nested replies: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		node := models.ReplyNode{Replies: make([]models.ReplyNode, 0)}
+		if err = rows.Scan(tweetFields(&node.Tweet)...); err != nil {
+			return nil, fmt.Errorf("Error scan nested reply: %w", err)
+		}
+		parent := byID[*node.InReplyToTweetID]
+		if len(parent.Replies) < limit {
+			parent.Replies = append(parent.Replies, node)
+		} else {
+			parent.MoreReplies = true
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error iterate nested reply rows: %w", err)
+	}
+
+	next := make([]*models.ReplyNode, 0)
+	for _, parent := range parents {
+		for i := range parent.Replies {
+			next = append(next, &parent.Replies[i])
+		}
+	}
+	return next, nil
+}
+
+func appendReplyTweets(tweets []*models.Tweet, nodes []models.ReplyNode) []*models.Tweet {
+	for i := range nodes {
+		tweets = append(tweets, &nodes[i].Tweet)
+		tweets = appendReplyTweets(tweets, nodes[i].Replies)
+	}
+	return tweets
+}
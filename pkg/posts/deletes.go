@@ -0,0 +1,131 @@
+package posts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/me0888/twitter/pkg/apperr"
+	"github.com/me0888/twitter/pkg/models"
+)
+
+// Deleted tweets can be restored for DefaultUndoWindow and are purged once
+// they have been kept for DefaultRetention, unless SetUndoWindow and
+// SetRetention say otherwise. The comments service applies the same ones.
+const (
+	DefaultUndoWindow = 30 * time.Second
+	DefaultRetention  = 7 * 24 * time.Hour
+
+	purgeBatchSize = 1000
+)
+
+var ErrUndoWindowClosed = apperr.New(http.StatusForbidden, "undo_window_closed", "the time to undo the deletion has run out")
+
+// SetUndoWindow sets how long after deleting a tweet it may be restored.
+func (s *Service) SetUndoWindow(window time.Duration) {
+	s.undoWindow = window
+}
+
+// SetRetention sets how long deleted tweets are kept before Purge removes
+// them. It should not be shorter than the undo window.
+func (s *Service) SetRetention(retention time.Duration) {
+	s.retention = retention
+}
+
+// RestoreTweet undoes the deletion of tweetID while the undo window is open.
+// Restoring a tweet that is not deleted changes nothing, so clients can retry
+// it safely.
+func (s *Service) RestoreTweet(ctx context.Context, id int64, tweetID string) (models.Tweet, error) {
+	var resp models.Tweet
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return resp, fmt.Errorf("Error begin restore tweet: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var ownerID int64
+	var quoted *int64
+	var deleted, restorable bool
+	err = tx.QueryRow(ctx, `
+		SELECT user_id, quoted_tweet_id, deleted_at IS NOT NULL, deleted_at > now() - make_interval(secs => $2)
+		FROM tweets WHERE id = $1 FOR UPDATE`, tweetID, s.undoWindow.Seconds()).
+		Scan(&ownerID, &quoted, &deleted, &restorable)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return resp, ErrTweetNotFound
+	}
+	if err != nil {
+		return resp, fmt.Errorf("Error query select tweet: %w", err)
+	}
+
+	if ownerID != id {
+		return resp, ErrNotTweetOwner
+	}
+
+	if deleted {
+		if !restorable {
+			return resp, ErrUndoWindowClosed
+		}
+
+		if _, err = tx.Exec(ctx, `UPDATE tweets SET deleted_at = NULL WHERE id = $1`, tweetID); err != nil {
+			return resp, fmt.Errorf("Error restore tweet: %w", err)
+		}
+		if quoted != nil {
+			if _, err = tx.Exec(ctx, "UPDATE tweets SET quotes_count = quotes_count + 1 WHERE id = $1", *quoted); err != nil {
+				return resp, fmt.Errorf("Error update tweet quotes count: %w", err)
+			}
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return resp, fmt.Errorf("Error commit restore tweet: %w", err)
+	}
+
+	return s.GetTweet(ctx, id, tweetID)
+}
+
+// Purge removes for good the tweets deleted longer than the retention ago,
+// together with their likes, retweets, comments and revisions, a batch at a
+// time. It returns how many tweets it removed.
+func (s *Service) Purge(ctx context.Context) (int64, error) {
+	var purged int64
+	for {
+		tag, err := s.pool.Exec(ctx, `
+			DELETE FROM tweets WHERE id IN (
+				SELECT id FROM tweets WHERE deleted_at <= now() - make_interval(secs => $1)
+				ORDER BY id LIMIT $2)`, s.retention.Seconds(), purgeBatchSize)
+		if err != nil {
+			return purged, fmt.Errorf("Error purge tweets: %w", err)
+		}
+		purged += tag.RowsAffected()
+		if tag.RowsAffected() < purgeBatchSize {
+			return purged, nil
+		}
+	}
+}
+
+// StartPurger runs Purge every interval until ctx is cancelled.
+func (s *Service) StartPurger(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := s.Purge(ctx)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			if n > 0 {
+				log.Printf("Purger removed %d deleted tweets", n)
+			}
+		}
+	}
+}
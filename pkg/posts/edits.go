@@ -0,0 +1,130 @@
+package posts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/me0888/twitter/pkg/apperr"
+	"github.com/me0888/twitter/pkg/models"
+)
+
+// Limits of edits, unless SetEditWindow and SetMaxEdits say otherwise. The
+// comments service applies the same ones.
+const (
+	DefaultEditWindow = time.Hour
+	DefaultMaxEdits   = 5
+)
+
+var ErrEditWindowClosed = apperr.New(http.StatusForbidden, "edit_window_closed", "the time to edit has run out")
+var ErrEditLimitReached = apperr.New(http.StatusForbidden, "edit_limit_reached", "no more edits are allowed")
+
+// SetEditWindow sets how long after posting a tweet may be edited.
+func (s *Service) SetEditWindow(window time.Duration) {
+	s.editWindow = window
+}
+
+// SetMaxEdits sets how many times a tweet may be edited.
+func (s *Service) SetMaxEdits(n int) {
+	s.maxEdits = n
+}
+
+// UpdateTweet replaces the content of tweet.ID and keeps the content it had
+// as a revision. Setting the content it already has changes nothing, so
+// clients can retry it safely.
+func (s *Service) UpdateTweet(ctx context.Context, id int64, tweet models.Tweet) (models.Tweet, error) {
+	var resp models.Tweet
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return resp, fmt.Errorf("Error begin update tweet: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var ownerID int64
+	var content string
+	var writtenAt time.Time
+	var edits int
+	var editable bool
+	err = tx.QueryRow(ctx, `
+		SELECT user_id, content, updated_at, edits_count, created_at > now() - make_interval(secs => $2)
+		FROM tweets WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`, tweet.ID, s.editWindow.Seconds()).
+		Scan(&ownerID, &content, &writtenAt, &edits, &editable)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return resp, ErrTweetNotFound
+	}
+	if err != nil {
+		return resp, fmt.Errorf("Error query select tweet: %w", err)
+	}
+
+	if ownerID != id {
+		return resp, ErrNotTweetOwner
+	}
+
+	if content != tweet.Content {
+		if !editable {
+			return resp, ErrEditWindowClosed
+		}
+		if edits >= s.maxEdits {
+			return resp, ErrEditLimitReached
+		}
+
+		if _, err = tx.Exec(ctx, `INSERT INTO tweet_revisions (tweet_id, content, created_at) VALUES ($1, $2, $3)`,
+			tweet.ID, content, writtenAt); err != nil {
+			return resp, fmt.Errorf("Error insert tweet revision: %w", err)
+		}
+		if _, err = tx.Exec(ctx, `UPDATE tweets SET content = $2, updated_at = now(), edits_count = edits_count + 1 WHERE id = $1`,
+			tweet.ID, tweet.Content); err != nil {
+			return resp, fmt.Errorf("Error update tweet: %w", err)
+		}
+	}
+
+	if err = tx.QueryRow(ctx, `SELECT `+tweetColumns+` FROM tweets WHERE id = $1`, tweet.ID).Scan(tweetFields(&resp)...); err != nil {
+		return resp, fmt.Errorf("Error select post : %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return resp, fmt.Errorf("Error commit update tweet: %w", err)
+	}
+
+	if err = s.fill(ctx, id, []*models.Tweet{&resp}); err != nil {
+		return resp, err
+	}
+	return resp, nil
+}
+
+// GetTweetHistory returns tweetID with the versions it had before its edits.
+func (s *Service) GetTweetHistory(ctx context.Context, viewerID int64, tweetID string) (models.TweetHistory, error) {
+	var history models.TweetHistory
+
+	tweet, err := s.GetTweet(ctx, viewerID, tweetID)
+	if err != nil {
+		return history, err
+	}
+	history.Tweet = tweet
+
+	rows, err := s.pool.Query(ctx, `
+		SELECT content, created_at FROM tweet_revisions
+		WHERE tweet_id = $1
+		ORDER BY created_at, id`, tweet.ID)
+	if err != nil {
+		return history, fmt.Errorf("Error query tweet revisions: %w", err)
+	}
+	defer rows.Close()
+
+	history.Revisions = make([]models.Revision, 0)
+	for rows.Next() {
+		var r models.Revision
+		if err = rows.Scan(&r.Content, &r.CreatedAt); err != nil {
+			return history, fmt.Errorf("Error scan tweet revision: %w", err)
+		}
+		history.Revisions = append(history.Revisions, r)
+	}
+	if err = rows.Err(); err != nil {
+		return history, fmt.Errorf("Error iterate tweet revision rows: %w", err)
+	}
+	return history, nil
+}
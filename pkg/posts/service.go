@@ -2,140 +2,431 @@ package posts
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/me0888/twitter/pkg/apperr"
 	"github.com/me0888/twitter/pkg/models"
+	"github.com/me0888/twitter/pkg/pagination"
+	"github.com/me0888/twitter/pkg/timeline"
+)
+
+var ErrTweetNotFound = apperr.New(http.StatusNotFound, "tweet_not_found", "tweet not found")
+var ErrNotTweetOwner = apperr.New(http.StatusForbidden, "not_tweet_owner", "tweet belongs to another user")
+var ErrRetweetOwnTweet = apperr.New(http.StatusBadRequest, "cannot_retweet_own", "you can not retweet your own tweet")
+
+// Tweets are listed newest first, the timeline by its latest events and
+// users by username.
+var (
+	tweetKeys    = pagination.Keyset{Key: "tweets.created_at", ID: "tweets.id", Type: "timestamptz", Desc: true}
+	timelineKeys = pagination.Keyset{Key: "timeline.at", ID: "timeline.tweet_id", Type: "timestamptz", Desc: true}
+	userKeys     = pagination.Keyset{Key: "users.username", ID: "users.id", Type: "text"}
 )
 
 type Service struct {
-	pool *pgxpool.Pool
+	pool       *pgxpool.Pool
+	timeline   *timeline.Service
+	editWindow time.Duration
+	maxEdits   int
+	undoWindow time.Duration
+	retention  time.Duration
 }
 
 func NewService(pool *pgxpool.Pool) *Service {
-	return &Service{pool: pool}
+	return &Service{pool: pool, editWindow: DefaultEditWindow, maxEdits: DefaultMaxEdits,
+		undoWindow: DefaultUndoWindow, retention: DefaultRetention}
+}
+
+// SetTimeline makes new tweets and retweets reach the home timelines kept
+// by t. Without it they are never fanned out and ReadTweets merges them in.
+func (s *Service) SetTimeline(t *timeline.Service) {
+	s.timeline = t
 }
 
-func (s *Service) CreateTweet(ctx context.Context, id int64, content string) (models.Tweet, error) {
+// tweetColumns are the columns tweetFields scans, in the same order.
+const tweetColumns = `tweets.id, tweets.content, tweets.likes_count, tweets.comments_count, tweets.retweets_count,
+	tweets.quotes_count, tweets.in_reply_to_tweet_id, tweets.conversation_id, tweets.quoted_tweet_id,
+	tweets.edits_count > 0, tweets.created_at, tweets.updated_at`
+
+func tweetFields(p *models.Tweet) []interface{} {
+	return []interface{}{&p.ID, &p.Content, &p.LikesCount, &p.CommentsCount, &p.RetweetsCount,
+		&p.QuotesCount, &p.InReplyToTweetID, &p.ConversationID, &p.QuotedTweetID, &p.Edited, &p.CreatedAt, &p.UpdatedAt}
+}
+
+// CreateTweet posts a tweet. A reply joins the conversation of the tweet it
+// answers; a quote is counted on the tweet it quotes.
+func (s *Service) CreateTweet(ctx context.Context, id int64, in models.CreatePostInput) (models.Tweet, error) {
 	var post models.Tweet
 
-	err := s.pool.QueryRow(ctx,
-		`INSERT INTO tweets (user_id, content) VALUES ($1, $2) RETURNING id, content, created_at, updated_at;`,
-		id, content).Scan(&post.ID, &post.Content, &post.CreatedAt, &post.UpdatedAt)
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return post, fmt.Errorf("Error begin tweet: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if in.InReplyToTweetID != nil {
+		var exists bool
+		if err = tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM tweets WHERE id = $1 AND deleted_at IS NULL)`, *in.InReplyToTweetID).Scan(&exists); err != nil {
+			return post, fmt.Errorf("Error query select tweet: %w", err)
+		}
+		if !exists {
+			return post, ErrTweetNotFound
+		}
+	}
+
+	if in.QuotedTweetID != nil {
+		var quoted int64
+		err = tx.QueryRow(ctx, `SELECT id FROM tweets WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`, *in.QuotedTweetID).Scan(&quoted)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return post, ErrTweetNotFound
+		}
+		if err != nil {
+			return post, fmt.Errorf("Error query select quoted tweet: %w", err)
+		}
+	}
+
+	err = tx.QueryRow(ctx, `
+		WITH new AS (SELECT nextval(pg_get_serial_sequence('tweets', 'id'))::INT AS id)
+		INSERT INTO tweets (id, user_id, content, in_reply_to_tweet_id, conversation_id, quoted_tweet_id)
+		SELECT new.id, $1, $2, $3, COALESCE((SELECT conversation_id FROM tweets WHERE id = $3), new.id), $4
+		FROM new
+		RETURNING `+tweetColumns,
+		id, in.Content, in.InReplyToTweetID, in.QuotedTweetID).Scan(tweetFields(&post)...)
 	if err != nil {
-		return post, fmt.Errorf("Error insert : %v", err)
+		return post, fmt.Errorf("Error insert : %w", err)
+	}
+
+	if in.QuotedTweetID != nil {
+		if _, err = tx.Exec(ctx, "UPDATE tweets SET quotes_count = quotes_count + 1 WHERE id = $1", *in.QuotedTweetID); err != nil {
+			return post, fmt.Errorf("Error update tweet quotes count: %w", err)
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return post, fmt.Errorf("Error commit tweet: %w", err)
+	}
+	post.UserID = id
+
+	if s.timeline != nil {
+		s.timeline.Tweeted(post.ID)
 	}
 
 	return post, nil
 }
 
-func (s *Service) GetTweet(ctx context.Context, tweetID string) (models.Tweet, error) {
+func (s *Service) GetTweet(ctx context.Context, viewerID int64, tweetID string) (models.Tweet, error) {
+	p, err := s.tweet(ctx, tweetID)
+	if err != nil {
+		return p, err
+	}
+	if err = s.fill(ctx, viewerID, []*models.Tweet{&p}); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+// tweet loads tweetID without the fields fill sets.
+func (s *Service) tweet(ctx context.Context, tweetID string) (models.Tweet, error) {
 	var p models.Tweet
-	err := s.pool.QueryRow(ctx,
-		`SELECT id, content, likes_count, comments_count, retweets_count, created_at, updated_at
-		FROM tweets WHERE id = $1;`, tweetID).
-		Scan(&p.ID, &p.Content, &p.LikesCount, &p.CommentsCount, &p.RetweetsCount, &p.CreatedAt, &p.UpdatedAt)
+	err := s.pool.QueryRow(ctx, `SELECT `+tweetColumns+` FROM tweets WHERE id = $1 AND deleted_at IS NULL;`, tweetID).
+		Scan(tweetFields(&p)...)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return p, ErrTweetNotFound
+	}
 	if err != nil {
-		return p, fmt.Errorf("Error select post : %v", err)
+		return p, fmt.Errorf("Error select post : %w", err)
 	}
 	return p, nil
 }
 
-func (s *Service) TweetLike(ctx context.Context, userID int64, tweetID string) (models.LikeResponse, error) {
-	var response models.LikeResponse
+// fill sets the author of every tweet, the flags that depend on who is
+// looking and the tweets they quote.
+func (s *Service) fill(ctx context.Context, viewerID int64, tweets []*models.Tweet) error {
+	if err := s.fillAuthors(ctx, viewerID, tweets); err != nil {
+		return err
+	}
+	return s.fillQuotes(ctx, viewerID, tweets)
+}
 
-	if err := s.pool.QueryRow(ctx, `SELECT EXISTS (
-            SELECT 1 from tweet_likes WHERE user_id = $1 AND tweet_id = $2)
-    `, userID, tweetID).Scan(&response.Liked); err != nil {
-		return response, fmt.Errorf("Error query select tweet like : %v", err)
+// fillAuthors sets the author and viewer flags of every tweet with one query
+// for all of them.
+func (s *Service) fillAuthors(ctx context.Context, viewerID int64, tweets []*models.Tweet) error {
+	if len(tweets) == 0 {
+		return nil
 	}
-	if response.Liked {
 
-		if _, err := s.pool.Exec(ctx, "DELETE FROM tweet_likes WHERE user_id = $1 AND tweet_id = $2", userID, tweetID); err != nil {
-			return response, fmt.Errorf("Error query delete tweet like: %v", err)
+	ids := make([]int64, 0, len(tweets))
+	byID := make(map[int64][]*models.Tweet, len(tweets))
+	for _, t := range tweets {
+		if _, ok := byID[t.ID]; !ok {
+			ids = append(ids, t.ID)
 		}
+		byID[t.ID] = append(byID[t.ID], t)
+	}
 
-		if err := s.pool.QueryRow(ctx, "UPDATE tweets SET likes_count = likes_count - 1 WHERE id = $1 RETURNING likes_count", tweetID).
-			Scan(&response.LikesCount); err != nil {
-			return response, fmt.Errorf("Error update tweet likes count: %v", err)
+	rows, err := s.pool.Query(ctx, `
+		SELECT tweets.id, users.id, users.username, COALESCE(users.avatar, ''),
+			EXISTS (SELECT 1 FROM tweet_likes WHERE user_id = $2 AND tweet_id = tweets.id),
+			EXISTS (SELECT 1 FROM tweet_retweets WHERE user_id = $2 AND tweet_id = tweets.id)
+		FROM tweets JOIN users ON users.id = tweets.user_id
+		WHERE tweets.id = ANY($1)`, ids, viewerID)
+	if err != nil {
+		return fmt.Errorf("Error query tweet authors: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, authorID int64
+		var username, avatar string
+		var liked, retweeted bool
+		if err = rows.Scan(&id, &authorID, &username, &avatar, &liked, &retweeted); err != nil {
+			return fmt.Errorf("Error scan tweet author: %w", err)
+		}
+		for _, t := range byID[id] {
+			t.UserID = authorID
+			t.Author = models.NewUserRef(authorID, username, avatar)
+			t.LikedByMe = liked
+			t.RetweetedByMe = retweeted
+			t.IsMine = authorID == viewerID
 		}
-	} else {
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("Error iterate tweet author rows: %w", err)
+	}
+	return nil
+}
 
-		_, err := s.pool.Exec(ctx, "INSERT INTO tweet_likes (user_id, tweet_id) VALUES ($1, $2)", userID, tweetID)
+// fillQuotes embeds the tweets quoted by tweets, filled for the viewer, or
+// says why one can not be shown. A deleted tweet is gone for everybody as
+// soon as it is deleted, even while the deletion can still be undone.
+func (s *Service) fillQuotes(ctx context.Context, viewerID int64, tweets []*models.Tweet) error {
+	ids := make([]int64, 0)
+	for _, t := range tweets {
+		if t.QuotedTweetID != nil {
+			ids = append(ids, *t.QuotedTweetID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
 
-		if err != nil {
-			return response, fmt.Errorf("Error insert tweet like: %v", err)
+	rows, err := s.pool.Query(ctx, `SELECT `+tweetColumns+` FROM tweets WHERE id = ANY($1) AND deleted_at IS NULL`, ids)
+	if err != nil {
+		return fmt.Errorf("Error query quoted tweets: %w", err)
+	}
+	defer rows.Close()
+
+	quoted := make(map[int64]*models.Tweet)
+	for rows.Next() {
+		var t models.Tweet
+		if err = rows.Scan(tweetFields(&t)...); err != nil {
+			return fmt.Errorf("Error scan quoted tweet: %w", err)
 		}
+		quoted[t.ID] = &t
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("Error iterate quoted tweet rows: %w", err)
+	}
+
+	refs := make([]*models.Tweet, 0, len(quoted))
+	for _, t := range quoted {
+		refs = append(refs, t)
+	}
+	if err = s.fillAuthors(ctx, viewerID, refs); err != nil {
+		return err
+	}
 
-		if err := s.pool.QueryRow(ctx, "UPDATE tweets SET likes_count = likes_count + 1 WHERE id = $1 RETURNING likes_count", tweetID).
-			Scan(&response.LikesCount); err != nil {
-			return response, fmt.Errorf("Error update tweet likes count: %v", err)
+	for _, t := range tweets {
+		if t.QuotedTweetID == nil {
+			continue
+		}
+		t.QuotedTweet = &models.QuotedTweet{ID: *t.QuotedTweetID, Unavailable: models.QuoteDeleted}
+		if q, ok := quoted[*t.QuotedTweetID]; ok {
+			embedded := *q
+			t.QuotedTweet.Tweet, t.QuotedTweet.Unavailable = &embedded, ""
 		}
+	}
+	return nil
+}
+
+func tweetRefs(pp []models.Tweet) []*models.Tweet {
+	refs := make([]*models.Tweet, len(pp))
+	for i := range pp {
+		refs[i] = &pp[i]
+	}
+	return refs
+}
+
+// tweetOwner returns the author of tweetID, or ErrTweetNotFound.
+func (s *Service) tweetOwner(ctx context.Context, tweetID string) (int64, error) {
+	var userID int64
+
+	err := s.pool.QueryRow(ctx, `SELECT user_id FROM tweets WHERE id = $1 AND deleted_at IS NULL`, tweetID).Scan(&userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, ErrTweetNotFound
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Error query select tweet : %w", err)
+	}
+
+	return userID, nil
+}
+
+// TweetLike toggles the like of userID on tweetID.
+func (s *Service) TweetLike(ctx context.Context, userID int64, tweetID string) (models.LikeResponse, error) {
+	return s.setTweetLike(ctx, userID, tweetID, nil)
+}
+
+// SetTweetLike likes or unlikes tweetID. Repeating the call changes nothing,
+// so clients can retry it safely.
+func (s *Service) SetTweetLike(ctx context.Context, userID int64, tweetID string, liked bool) (models.LikeResponse, error) {
+	return s.setTweetLike(ctx, userID, tweetID, &liked)
+}
+
+// setTweetLike brings the like to the wanted state, or flips it when wanted
+// is nil, in one transaction holding the tweet row lock so that concurrent
+// requests cannot count a like twice.
+func (s *Service) setTweetLike(ctx context.Context, userID int64, tweetID string, wanted *bool) (models.LikeResponse, error) {
+	var response models.LikeResponse
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return response, fmt.Errorf("Error begin tweet like: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.QueryRow(ctx, `SELECT likes_count FROM tweets WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`, tweetID).Scan(&response.LikesCount)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return response, ErrTweetNotFound
+	}
+	if err != nil {
+		return response, fmt.Errorf("Error query select tweet: %w", err)
+	}
+
+	if err = tx.QueryRow(ctx, `SELECT EXISTS (
+            SELECT 1 from tweet_likes WHERE user_id = $1 AND tweet_id = $2)
+    `, userID, tweetID).Scan(&response.Liked); err != nil {
+		return response, fmt.Errorf("Error query select tweet like : %w", err)
+	}
+
+	liked := !response.Liked
+	if wanted != nil {
+		liked = *wanted
+	}
+	if liked == response.Liked {
+		return response, nil
+	}
+
+	query, delta := "INSERT INTO tweet_likes (user_id, tweet_id) VALUES ($1, $2)", 1
+	if !liked {
+		query, delta = "DELETE FROM tweet_likes WHERE user_id = $1 AND tweet_id = $2", -1
+	}
+	if _, err = tx.Exec(ctx, query, userID, tweetID); err != nil {
+		return response, fmt.Errorf("Error update tweet like: %w", err)
+	}
+
+	if err = tx.QueryRow(ctx, "UPDATE tweets SET likes_count = likes_count + $2 WHERE id = $1 RETURNING likes_count", tweetID, delta).
+		Scan(&response.LikesCount); err != nil {
+		return response, fmt.Errorf("Error update tweet likes count: %w", err)
+	}
 
+	if err = tx.Commit(ctx); err != nil {
+		return response, fmt.Errorf("Error commit tweet like: %w", err)
 	}
 
-	response.Liked = !response.Liked
+	response.Liked = liked
 	return response, nil
 }
 
+// TweetRetweet toggles the retweet of tweetID by userID.
 func (s *Service) TweetRetweet(ctx context.Context, userID int64, tweetID string) (models.RetweetResponse, error) {
+	return s.setTweetRetweet(ctx, userID, tweetID, nil)
+}
+
+// SetTweetRetweet retweets or un-retweets tweetID. Repeating the call
+// changes nothing, so clients can retry it safely.
+func (s *Service) SetTweetRetweet(ctx context.Context, userID int64, tweetID string, retweeted bool) (models.RetweetResponse, error) {
+	return s.setTweetRetweet(ctx, userID, tweetID, &retweeted)
+}
+
+// setTweetRetweet works like setTweetLike for tweet_retweets.
+func (s *Service) setTweetRetweet(ctx context.Context, userID int64, tweetID string, wanted *bool) (models.RetweetResponse, error) {
 	var response models.RetweetResponse
-	var ownPost bool
+	var id, ownerID int64
 
-	if err := s.pool.QueryRow(ctx, `SELECT EXISTS (
-            SELECT 1 from tweet_retweets WHERE user_id = $1 AND tweet_id = $2)
-    `, userID, tweetID).Scan(&response.Retweeted); err != nil {
-		return response, fmt.Errorf("Error query select tweet retweet : %v", err)
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return response, fmt.Errorf("Error begin tweet retweet: %w", err)
 	}
+	defer tx.Rollback(ctx)
 
-	if err := s.pool.QueryRow(ctx, `SELECT EXISTS (
-            SELECT 1 from tweets WHERE user_id = $1 AND id = $2)
-    `, userID, tweetID).Scan(&ownPost); err != nil {
-		return response, fmt.Errorf("Error query select tweet : %v", err)
+	err = tx.QueryRow(ctx, `SELECT id, user_id, retweets_count FROM tweets WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`, tweetID).
+		Scan(&id, &ownerID, &response.RetweesCount)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return response, ErrTweetNotFound
 	}
-
-	if ownPost {
-		return response, fmt.Errorf("You cant`t retweet you own tweet")
+	if err != nil {
+		return response, fmt.Errorf("Error query select tweet: %w", err)
 	}
 
-	if response.Retweeted {
+	if ownerID == userID {
+		return response, ErrRetweetOwnTweet
+	}
 
-		if _, err := s.pool.Exec(ctx, "DELETE FROM tweet_retweets WHERE user_id = $1 AND tweet_id = $2", userID, tweetID); err != nil {
-			return response, fmt.Errorf("Error query delete retweets : %v", err)
-		}
+	if err = tx.QueryRow(ctx, `SELECT EXISTS (
+            SELECT 1 from tweet_retweets WHERE user_id = $1 AND tweet_id = $2)
+    `, userID, tweetID).Scan(&response.Retweeted); err != nil {
+		return response, fmt.Errorf("Error query select tweet retweet : %w", err)
+	}
 
-		if err := s.pool.QueryRow(ctx, "UPDATE tweets SET retweets_count = retweets_count - 1 WHERE id = $1 RETURNING retweets_count", tweetID).
-			Scan(&response.RetweesCount); err != nil {
-			return response, fmt.Errorf("Error update tweet retweets count: %v", err)
-		}
-	} else {
+	retweeted := !response.Retweeted
+	if wanted != nil {
+		retweeted = *wanted
+	}
+	if retweeted == response.Retweeted {
+		return response, nil
+	}
 
-		_, err := s.pool.Exec(ctx, "INSERT INTO tweet_retweets (user_id, tweet_id) VALUES ($1, $2)", userID, tweetID)
+	query, delta := "INSERT INTO tweet_retweets (user_id, tweet_id) VALUES ($1, $2)", 1
+	if !retweeted {
+		query, delta = "DELETE FROM tweet_retweets WHERE user_id = $1 AND tweet_id = $2", -1
+	}
+	if _, err = tx.Exec(ctx, query, userID, tweetID); err != nil {
+		return response, fmt.Errorf("Error update retweet: %w", err)
+	}
 
-		if err != nil {
-			return response, fmt.Errorf("Error insert retweets like: %v", err)
-		}
+	if err = tx.QueryRow(ctx, "UPDATE tweets SET retweets_count = retweets_count + $2 WHERE id = $1 RETURNING retweets_count", tweetID, delta).
+		Scan(&response.RetweesCount); err != nil {
+		return response, fmt.Errorf("Error update tweet retweets count: %w", err)
+	}
 
-		if err := s.pool.QueryRow(ctx, "UPDATE tweets SET retweets_count = retweets_count + 1 WHERE id = $1 RETURNING retweets_count", tweetID).
-			Scan(&response.RetweesCount); err != nil {
-			return response, fmt.Errorf("Error update tweet retweets count: %v", err)
-		}
+	if err = tx.Commit(ctx); err != nil {
+		return response, fmt.Errorf("Error commit tweet retweet: %w", err)
+	}
 
+	if s.timeline != nil {
+		s.timeline.Retweeted(userID, id, retweeted)
 	}
 
-	response.Retweeted = !response.Retweeted
+	response.Retweeted = retweeted
 	return response, nil
 }
 
-func (s *Service) TweetLikes(ctx context.Context, tweetID string) ([]models.UserProfile, error) {
+func (s *Service) TweetLikes(ctx context.Context, tweetID string, page pagination.Query) (pagination.Page, error) {
+	where, tail, args := userKeys.Clause(page, 2)
 	rows, err := s.pool.Query(ctx, `
 		SELECT id, email, username, followers_count, followees_count
 		FROM tweet_likes, users
 		WHERE tweet_likes.tweet_id = $1 
 		AND users.id=tweet_likes.user_id
-		ORDER BY username ASC
-		`, tweetID)
+		AND tweet_likes.tweet_id IN (SELECT id FROM tweets WHERE deleted_at IS NULL)
+		AND `+where+` `+tail, append([]interface{}{tweetID}, args...)...)
 	if err != nil {
-		return nil, fmt.Errorf("Error query select: %v", err)
+		return pagination.Page{}, fmt.Errorf("Error query select: %w", err)
 	}
 	defer rows.Close()
 	uu := make([]models.UserProfile, 0)
@@ -143,27 +434,30 @@ func (s *Service) TweetLikes(ctx context.Context, tweetID string) ([]models.User
 		var u models.UserProfile
 
 		if err = rows.Scan(&u.ID, &u.Email, &u.UserName, &u.FollowersCount, &u.FolloweesCount); err != nil {
-			return nil, fmt.Errorf("Error scan user: %v", err)
+			return pagination.Page{}, fmt.Errorf("Error scan user: %w", err)
 		}
 
 		uu = append(uu, u)
 	}
 	if err = rows.Err(); err != nil {
-		return nil, fmt.Errorf("Error iterate user rows: %v", err)
+		return pagination.Page{}, fmt.Errorf("Error iterate user rows: %w", err)
 	}
-	return uu, nil
+	return page.Page(uu, func(i int) pagination.Cursor {
+		return pagination.Cursor{Key: uu[i].UserName, ID: uu[i].ID}
+	}), nil
 }
 
-func (s *Service) TweetRetweetedUsers(ctx context.Context, tweetID string) ([]models.UserProfile, error) {
+func (s *Service) TweetRetweetedUsers(ctx context.Context, tweetID string, page pagination.Query) (pagination.Page, error) {
+	where, tail, args := userKeys.Clause(page, 2)
 	rows, err := s.pool.Query(ctx, `
 		SELECT id, email, username, followers_count, followees_count
 		FROM tweet_retweets, users
 		WHERE tweet_retweets.tweet_id = $1 
 		AND users.id=tweet_retweets.user_id
-		ORDER BY username ASC
-		`, tweetID)
+		AND tweet_retweets.tweet_id IN (SELECT id FROM tweets WHERE deleted_at IS NULL)
+		AND `+where+` `+tail, append([]interface{}{tweetID}, args...)...)
 	if err != nil {
-		return nil, fmt.Errorf("Error query select: %v", err)
+		return pagination.Page{}, fmt.Errorf("Error query select: %w", err)
 	}
 	defer rows.Close()
 	uu := make([]models.UserProfile, 0)
@@ -171,26 +465,29 @@ func (s *Service) TweetRetweetedUsers(ctx context.Context, tweetID string) ([]mo
 		var u models.UserProfile
 
 		if err = rows.Scan(&u.ID, &u.Email, &u.UserName, &u.FollowersCount, &u.FolloweesCount); err != nil {
-			return nil, fmt.Errorf("Error scan user: %v", err)
+			return pagination.Page{}, fmt.Errorf("Error scan user: %w", err)
 		}
 
 		uu = append(uu, u)
 	}
 	if err = rows.Err(); err != nil {
-		return nil, fmt.Errorf("Error iterate user rows: %v", err)
+		return pagination.Page{}, fmt.Errorf("Error iterate user rows: %w", err)
 	}
-	return uu, nil
+	return page.Page(uu, func(i int) pagination.Cursor {
+		return pagination.Cursor{Key: uu[i].UserName, ID: uu[i].ID}
+	}), nil
 }
 
-func (s *Service) GetTweets(ctx context.Context, username string) ([]models.Tweet, error) {
+func (s *Service) GetTweets(ctx context.Context, viewerID int64, username string, page pagination.Query) (pagination.Page, error) {
+	where, tail, args := tweetKeys.Clause(page, 2)
 	rows, err := s.pool.Query(ctx, `
-		SELECT id, content, likes_count, comments_count, created_at
+		SELECT `+tweetColumns+`
 		FROM tweets
 		WHERE user_id = (SELECT id FROM users WHERE username = $1) 
-		ORDER BY created_at DESC
-		`, username)
+		AND deleted_at IS NULL
+		AND `+where+` `+tail, append([]interface{}{username}, args...)...)
 	if err != nil {
-		return nil, fmt.Errorf("Error query select: %v", err)
+		return pagination.Page{}, fmt.Errorf("Error query select: %w", err)
 	}
 
 	defer rows.Close()
@@ -198,92 +495,168 @@ func (s *Service) GetTweets(ctx context.Context, username string) ([]models.Twee
 	pp := make([]models.Tweet, 0)
 	for rows.Next() {
 		var p models.Tweet
-		if err = rows.Scan(&p.ID, &p.Content, &p.LikesCount, &p.CommentsCount, &p.CreatedAt); err != nil {
-			return nil, fmt.Errorf("Error scan user: %v", err)
+		if err = rows.Scan(tweetFields(&p)...); err != nil {
+			return pagination.Page{}, fmt.Errorf("Error scan user: %w", err)
 		}
 
 		pp = append(pp, p)
 	}
 	if err = rows.Err(); err != nil {
-		return nil, fmt.Errorf("Error iterate user rows: %v", err)
+		return pagination.Page{}, fmt.Errorf("Error iterate user rows: %w", err)
 	}
-	return pp, nil
+	if err = s.fill(ctx, viewerID, tweetRefs(pp)); err != nil {
+		return pagination.Page{}, err
+	}
+	return page.Page(pp, func(i int) pagination.Cursor {
+		return pagination.TimeCursor(pp[i].CreatedAt, pp[i].ID)
+	}), nil
 }
 
-func (s *Service) UpdateTweet(ctx context.Context, id int64, tweet models.Tweet) (models.Tweet, error) {
-	var resp models.Tweet
-	var exsist bool
-
-	if err := s.pool.QueryRow(ctx, `
-	SELECT EXISTS (SELECT 1 FROM tweets WHERE id = $1 AND user_id = $2)`, tweet.ID, id).
-		Scan(&exsist); err != nil {
-		return resp, fmt.Errorf("Error query select tweets : %v", err)
+// GetQuotes returns a page of the tweets quoting tweetID, newest first.
+func (s *Service) GetQuotes(ctx context.Context, viewerID int64, tweetID string, page pagination.Query) (pagination.Page, error) {
+	where, tail, args := tweetKeys.Clause(page, 2)
+	rows, err := s.pool.Query(ctx, `
+		SELECT `+tweetColumns+`
+		FROM tweets
+		WHERE quoted_tweet_id = $1 AND deleted_at IS NULL
+		AND `+where+` `+tail, append([]interface{}{tweetID}, args...)...)
+	if err != nil {
+		return pagination.Page{}, fmt.Errorf("Error query quotes: %w", err)
 	}
+	defer rows.Close()
 
-	if exsist {
-		if _, err := s.pool.Exec(ctx, "UPDATE tweets SET content=$2, updated_at=$3 WHERE id = $1 ",
-			tweet.ID, tweet.Content, tweet.UpdatedAt); err != nil {
-			return resp, fmt.Errorf("Error update tweet: %v", err)
+	pp := make([]models.Tweet, 0)
+	for rows.Next() {
+		var p models.Tweet
+		if err = rows.Scan(tweetFields(&p)...); err != nil {
+			return pagination.Page{}, fmt.Errorf("Error scan quote: %w", err)
 		}
-	} else {
-		return resp, fmt.Errorf("Error update tweet")
+		pp = append(pp, p)
 	}
-
-	return resp, nil
+	if err = rows.Err(); err != nil {
+		return pagination.Page{}, fmt.Errorf("Error iterate quote rows: %w", err)
+	}
+	if err = s.fill(ctx, viewerID, tweetRefs(pp)); err != nil {
+		return pagination.Page{}, err
+	}
+	return page.Page(pp, func(i int) pagination.Cursor {
+		return pagination.TimeCursor(pp[i].CreatedAt, pp[i].ID)
+	}), nil
 }
 
+// DeleteTweet hides tweetID, and with it its likes, retweets and comments,
+// until RestoreTweet brings it back or Purge removes it.
 func (s *Service) DeleteTweet(ctx context.Context, id int64, tweetID string) (models.Tweet, error) {
 	var resp models.Tweet
-	var exsist bool
 
-	if err := s.pool.QueryRow(ctx, `
-	SELECT EXISTS (SELECT 1 FROM tweets WHERE id = $1 AND user_id = $2)`, tweetID, id).
-		Scan(&exsist); err != nil {
-		return resp, fmt.Errorf("Error query select : %v", err)
+	ownerID, err := s.tweetOwner(ctx, tweetID)
+	if err != nil {
+		return resp, err
+	}
+
+	if ownerID != id {
+		return resp, ErrNotTweetOwner
+	}
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return resp, fmt.Errorf("Error begin delete tweet: %w", err)
 	}
+	defer tx.Rollback(ctx)
 
-	if exsist {
-		if err := s.pool.QueryRow(ctx, `DELETE FROM tweets WHERE id = $1 
-		RETURNING id, content, likes_count, comments_count, created_at, updated_at`,
-			tweetID).Scan(&resp.ID, &resp.Content, &resp.LikesCount, &resp.CommentsCount, &resp.CreatedAt, &resp.UpdatedAt); err != nil {
-			return resp, fmt.Errorf("Error delete tweet: %v", err)
+	err = tx.QueryRow(ctx, `UPDATE tweets SET deleted_at = now() WHERE id = $1 AND deleted_at IS NULL
+		RETURNING `+tweetColumns+`, tweets.deleted_at`,
+		tweetID).Scan(append(tweetFields(&resp), &resp.DeletedAt)...)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return resp, ErrTweetNotFound
+	}
+	if err != nil {
+		return resp, fmt.Errorf("Error delete tweet: %w", err)
+	}
+
+	if resp.QuotedTweetID != nil {
+		if _, err = tx.Exec(ctx, "UPDATE tweets SET quotes_count = quotes_count - 1 WHERE id = $1", *resp.QuotedTweetID); err != nil {
+			return resp, fmt.Errorf("Error update tweet quotes count: %w", err)
 		}
-	} else {
-		return resp, fmt.Errorf("Error delete tweet")
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return resp, fmt.Errorf("Error commit delete tweet: %w", err)
 	}
 
 	return resp, nil
 }
 
-func (s *Service) ReadTweets(ctx context.Context, id int64) ([]models.Tweet, error) {
-	rows, err := s.pool.Query(ctx, `
-		SELECT tweets.id, content, likes_count, comments_count, retweets_count, created_at, updated_at
-		FROM follows, users, tweets
-		WHERE follows.follower_id = $1 AND users.id=follows.followee_id AND tweets.user_id=followee_id 
-		UNION
-		SELECT tweets.id, content, likes_count, comments_count, retweets_count, created_at, updated_at
-		FROM tweets, tweet_retweets, users, follows
-		WHERE tweet_retweets.user_id =(SELECT followee_id WHERE follower_id = $1) 
-		AND tweets.id=tweet_retweets.tweet_id AND users.id=tweet_retweets.user_id
-		ORDER BY updated_at ASC
-		`, id)
+// ReadTweets returns the home timeline of the user: their own tweets, the
+// tweets of the users they follow and the tweets those users retweeted. A
+// tweet appears once, at its latest such event, attributed to the retweeter
+// when that event is a retweet. The timelines table holds the events that
+// were fanned out; the rest, those of accounts with too many followers at the
+// time and those not fanned out yet, are merged in here.
+func (s *Service) ReadTweets(ctx context.Context, id int64, page pagination.Query) (pagination.Page, error) {
+	size := timeline.DefaultSize
+	if s.timeline != nil {
+		size = s.timeline.Size()
+	}
 
+	where, tail, args := timelineKeys.Clause(page, 3)
+	rows, err := s.pool.Query(ctx, `
+		WITH followees AS (
+			SELECT followee_id FROM follows WHERE follower_id = $1
+		), events AS (
+			(SELECT tweet_id, at, retweeter_id
+			FROM timelines WHERE user_id = $1 ORDER BY at DESC LIMIT $2)
+			UNION ALL
+			(SELECT id, created_at, NULL::INT
+			FROM tweets WHERE NOT fanned_out AND deleted_at IS NULL AND (user_id = $1
+			OR user_id IN (SELECT followee_id FROM followees) AND `+timeline.ReplyVisible("$1", "tweets")+`)
+			ORDER BY created_at DESC LIMIT $2)
+			UNION ALL
+			(SELECT tweet_id, created_at, user_id
+			FROM tweet_retweets WHERE user_id IN (SELECT followee_id FROM followees) AND NOT fanned_out
+			ORDER BY created_at DESC LIMIT $2)
+		), timeline AS (
+			SELECT DISTINCT ON (tweet_id) tweet_id, at, retweeter_id
+			FROM events
+			ORDER BY tweet_id, at DESC, retweeter_id NULLS FIRST
+		)
+		SELECT `+tweetColumns+`,
+			timeline.at, users.id, users.username, COALESCE(users.avatar, '')
+		FROM timeline
+		JOIN tweets ON tweets.id = timeline.tweet_id AND tweets.deleted_at IS NULL
+		LEFT JOIN users ON users.id = timeline.retweeter_id
+		WHERE `+where+` `+tail, append([]interface{}{id, size}, args...)...)
 	if err != nil {
-		return nil, fmt.Errorf("Error query select : %v", err)
+		return pagination.Page{}, fmt.Errorf("Error query timeline: %w", err)
 	}
-
 	defer rows.Close()
 
-	pp := make([]models.Tweet, 0)
+	items := make([]models.TimelineItem, 0)
 	for rows.Next() {
-		var p models.Tweet
-		if err = rows.Scan(&p.ID, &p.Content, &p.LikesCount, &p.CommentsCount, &p.RetweetsCount, &p.CreatedAt, &p.UpdatedAt); err != nil {
-			return nil, fmt.Errorf("Error scan user: %v", err)
+		var item models.TimelineItem
+		var retweeterID *int64
+		var retweeterName, retweeterAvatar *string
+		p := &item.Tweet
+		if err = rows.Scan(append(tweetFields(p), &item.At, &retweeterID, &retweeterName, &retweeterAvatar)...); err != nil {
+			return pagination.Page{}, fmt.Errorf("Error scan timeline: %w", err)
 		}
-		pp = append(pp, p)
+		if retweeterID != nil {
+			item.RetweetedBy = models.NewUserRef(*retweeterID, *retweeterName, *retweeterAvatar)
+		}
+		items = append(items, item)
 	}
 	if err = rows.Err(); err != nil {
-		return nil, fmt.Errorf("Error iterate user rows: %v", err)
+		return pagination.Page{}, fmt.Errorf("Error iterate timeline rows: %w", err)
+	}
+
+	tweets := make([]*models.Tweet, len(items))
+	for i := range items {
+		tweets[i] = &items[i].Tweet
+	}
+	if err = s.fill(ctx, id, tweets); err != nil {
+		return pagination.Page{}, err
 	}
-	return pp, nil
+	return page.Page(items, func(i int) pagination.Cursor {
+		return pagination.TimeCursor(items[i].At, items[i].ID)
+	}), nil
 }
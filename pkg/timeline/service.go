@@ -0,0 +1,326 @@
+package timeline
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const (
+	// DefaultSize is how many entries a home timeline keeps.
+	DefaultSize = 800
+	// DefaultFanoutLimit is the follower count from which an account's new
+	// tweets and retweets are merged into timelines when they are read
+	// instead of being copied into every follower's timeline. Each tweet and
+	// retweet records in fanned_out which way it went, so an account
+	// crossing the limit does not move what it posted before.
+	DefaultFanoutLimit = 10000
+	// DefaultQueueSize is how many fan-out jobs may wait for the worker
+	// before writers have to wait too.
+	DefaultQueueSize = 1024
+
+	trimBatchSize = 1000
+)
+
+// upsert keeps the latest event of every tweet in a timeline.
+const upsert = `
+	ON CONFLICT (user_id, tweet_id) DO UPDATE SET at = EXCLUDED.at, retweeter_id = EXCLUDED.retweeter_id
+	WHERE EXCLUDED.at > timelines.at`
+
+type job func(ctx context.Context) error
+
+// ReplyVisible returns the condition under which the tweet row named tweet
+// shows up in the timeline of the user viewer through its author: when it
+// is not a reply, when it answers its own author, or when viewer wrote or
+// follows the author of the tweet it answers. Both are SQL expressions.
+func ReplyVisible(viewer string, tweet string) string {
+	return fmt.Sprintf(`(%[2]s.in_reply_to_tweet_id IS NULL OR EXISTS (
+		SELECT 1 FROM tweets parent WHERE parent.id = %[2]s.in_reply_to_tweet_id
+		AND (parent.user_id IN (%[2]s.user_id, %[1]s) OR EXISTS (
+			SELECT 1 FROM follows WHERE follower_id = %[1]s AND followee_id = parent.user_id))))`, viewer, tweet)
+}
+
+// Service maintains the timelines table: the home timeline of every user,
+// filled when tweets, retweets and follows happen rather than when it is
+// read. The changes are applied by a single worker, in the order they were
+// made.
+type Service struct {
+	pool        *pgxpool.Pool
+	size        int
+	fanoutLimit int
+	jobs        chan job
+}
+
+func NewService(pool *pgxpool.Pool) *Service {
+	return &Service{pool: pool, size: DefaultSize, fanoutLimit: DefaultFanoutLimit, jobs: make(chan job, DefaultQueueSize)}
+}
+
+func (s *Service) SetSize(size int) {
+	s.size = size
+}
+
+func (s *Service) Size() int {
+	return s.size
+}
+
+func (s *Service) SetFanoutLimit(limit int) {
+	s.fanoutLimit = limit
+}
+
+func (s *Service) FanoutLimit() int {
+	return s.fanoutLimit
+}
+
+// SetQueueSize must be called before the worker starts.
+func (s *Service) SetQueueSize(size int) {
+	s.jobs = make(chan job, size)
+}
+
+// Tweeted adds a new tweet to the timelines of its author and followers,
+// unless the author has too many followers. The tweet is marked fanned out
+// by the same statement, so one whose job is lost or fails is still merged
+// in when timelines are read.
+func (s *Service) Tweeted(tweetID int64) {
+	s.enqueue("tweet", func(ctx context.Context) error {
+		_, err := s.pool.Exec(ctx, `
+			WITH tweet AS (
+				UPDATE tweets SET fanned_out = TRUE
+				WHERE id = $1 AND (SELECT followers_count < $2 FROM users WHERE users.id = tweets.user_id)
+				RETURNING id, user_id, created_at, in_reply_to_tweet_id
+			)
+			INSERT INTO timelines (user_id, tweet_id, at, retweeter_id)
+			SELECT user_id, id, created_at, NULL::INT FROM tweet
+			UNION ALL
+			SELECT follows.follower_id, tweet.id, tweet.created_at, NULL::INT
+			FROM tweet
+			JOIN follows ON follows.followee_id = tweet.user_id
+			WHERE `+ReplyVisible("follows.follower_id", "tweet")+upsert, tweetID, s.fanoutLimit)
+		return err
+	})
+}
+
+// Retweeted adds a retweet to the timelines of the retweeter's followers
+// and marks it fanned out, as Tweeted does, or takes it out of them once it
+// is undone.
+func (s *Service) Retweeted(userID, tweetID int64, retweeted bool) {
+	if !retweeted {
+		s.enqueue("unretweet", func(ctx context.Context) error {
+			return s.remove(ctx, `DELETE FROM timelines WHERE tweet_id = $2 AND retweeter_id = $1`, userID, tweetID)
+		})
+		return
+	}
+
+	s.enqueue("retweet", func(ctx context.Context) error {
+		_, err := s.pool.Exec(ctx, `
+			WITH retweet AS (
+				UPDATE tweet_retweets SET fanned_out = TRUE
+				WHERE user_id = $1 AND tweet_id = $2 AND (SELECT followers_count < $3 FROM users WHERE id = $1)
+				RETURNING user_id, tweet_id, created_at
+			)
+			INSERT INTO timelines (user_id, tweet_id, at, retweeter_id)
+			SELECT follows.follower_id, retweet.tweet_id, retweet.created_at, retweet.user_id
+			FROM retweet
+			JOIN follows ON follows.followee_id = retweet.user_id`+upsert, userID, tweetID, s.fanoutLimit)
+		return err
+	})
+}
+
+// Followed backfills the follower's timeline with the latest fanned out
+// tweets and retweets of the followee, or takes them out of it on unfollow.
+func (s *Service) Followed(followerID, followeeID int64, following bool) {
+	if !following {
+		s.enqueue("unfollow", func(ctx context.Context) error {
+			return s.remove(ctx, `
+				DELETE FROM timelines WHERE user_id = $1 AND (retweeter_id = $2
+				OR retweeter_id IS NULL AND tweet_id IN (SELECT id FROM tweets WHERE user_id = $2))`,
+				followerID, followeeID)
+		})
+		return
+	}
+
+	s.enqueue("follow", func(ctx context.Context) error {
+		_, err := s.pool.Exec(ctx, `
+			INSERT INTO timelines (user_id, tweet_id, at, retweeter_id)
+			SELECT DISTINCT ON (tweet_id) $1::INT, tweet_id, at, retweeter_id
+			FROM (
+				(SELECT id AS tweet_id, created_at AS at, NULL::INT AS retweeter_id
+				FROM tweets WHERE user_id = $2 AND fanned_out AND deleted_at IS NULL AND `+ReplyVisible("$1", "tweets")+`
+				ORDER BY created_at DESC LIMIT $3)
+				UNION ALL
+				(SELECT tweet_id, created_at, user_id
+				FROM tweet_retweets WHERE user_id = $2 AND fanned_out ORDER BY created_at DESC LIMIT $3)
+			) events
+			ORDER BY tweet_id, at DESC, retweeter_id NULLS FIRST`+upsert, followerID, followeeID, s.size)
+		if err != nil {
+			return err
+		}
+		return s.trim(ctx, []int64{followerID})
+	})
+}
+
+// enqueue hands fn to the worker. When the queue is full the caller waits
+// for room, so that a burst slows writers down instead of losing entries or
+// running them out of order.
+func (s *Service) enqueue(name string, fn job) {
+	wrapped := func(ctx context.Context) error {
+		if err := fn(ctx); err != nil {
+			return fmt.Errorf("Error timeline %s: %w", name, err)
+		}
+		return nil
+	}
+
+	s.jobs <- wrapped
+}
+
+// remove deletes the timeline entries selected by query and puts back the
+// tweets among them that the same users still see through somebody else.
+func (s *Service) remove(ctx context.Context, query string, args ...interface{}) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, query+` RETURNING user_id, tweet_id`, args...)
+	if err != nil {
+		return err
+	}
+	var userIDs, tweetIDs []int64
+	for rows.Next() {
+		var userID, tweetID int64
+		if err = rows.Scan(&userID, &tweetID); err != nil {
+			rows.Close()
+			return err
+		}
+		userIDs = append(userIDs, userID)
+		tweetIDs = append(tweetIDs, tweetID)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	if len(userIDs) > 0 {
+		_, err = tx.Exec(ctx, `
+			INSERT INTO timelines (user_id, tweet_id, at, retweeter_id)
+			SELECT DISTINCT ON (entry.user_id, entry.tweet_id) entry.user_id, entry.tweet_id, events.at, events.retweeter_id
+			FROM unnest($1::INT[], $2::INT[]) AS entry(user_id, tweet_id)
+			CROSS JOIN LATERAL (
+				SELECT tweets.created_at AS at, NULL::INT AS retweeter_id
+				FROM tweets
+				WHERE tweets.id = entry.tweet_id AND (tweets.user_id = entry.user_id
+				OR tweets.fanned_out AND `+ReplyVisible("entry.user_id", "tweets")+` AND EXISTS (
+					SELECT 1 FROM follows WHERE follower_id = entry.user_id AND followee_id = tweets.user_id))
+				UNION ALL
+				SELECT tweet_retweets.created_at, tweet_retweets.user_id
+				FROM tweet_retweets
+				JOIN follows ON follows.followee_id = tweet_retweets.user_id AND follows.follower_id = entry.user_id
+				WHERE tweet_retweets.tweet_id = entry.tweet_id AND tweet_retweets.fanned_out
+			) events
+			ORDER BY entry.user_id, entry.tweet_id, events.at DESC, events.retweeter_id NULLS FIRST`+upsert,
+			userIDs, tweetIDs)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// trim drops the entries past the newest size ones from the given timelines.
+func (s *Service) trim(ctx context.Context, userIDs []int64) error {
+	_, err := s.pool.Exec(ctx, `
+		DELETE FROM timelines USING (
+			SELECT owner.id, cutoff.at, cutoff.tweet_id
+			FROM unnest($1::INT[]) AS owner(id)
+			CROSS JOIN LATERAL (
+				SELECT at, tweet_id FROM timelines WHERE user_id = owner.id
+				ORDER BY at DESC, tweet_id DESC OFFSET $2 LIMIT 1
+			) cutoff
+		) oldest
+		WHERE timelines.user_id = oldest.id AND (timelines.at, timelines.tweet_id) <= (oldest.at, oldest.tweet_id)`,
+		userIDs, s.size)
+	return err
+}
+
+// Trim trims every timeline, a batch of users at a time.
+func (s *Service) Trim(ctx context.Context) error {
+	var after int64
+	for {
+		userIDs := make([]int64, 0, trimBatchSize)
+		rows, err := s.pool.Query(ctx, `SELECT id FROM users WHERE id > $1 ORDER BY id LIMIT $2`, after, trimBatchSize)
+		if err != nil {
+			return fmt.Errorf("Error query users: %w", err)
+		}
+		for rows.Next() {
+			var id int64
+			if err = rows.Scan(&id); err != nil {
+				rows.Close()
+				return fmt.Errorf("Error scan user id: %w", err)
+			}
+			userIDs = append(userIDs, id)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return fmt.Errorf("Error iterate user rows: %w", err)
+		}
+		if len(userIDs) == 0 {
+			return nil
+		}
+
+		if err = s.trim(ctx, userIDs); err != nil {
+			return fmt.Errorf("Error trim timelines: %w", err)
+		}
+		if len(userIDs) < trimBatchSize {
+			return nil
+		}
+		after = userIDs[len(userIDs)-1]
+	}
+}
+
+// Start runs queued jobs until ctx is done, then runs the ones still queued
+// so that no accepted change is lost on shutdown. Jobs are not cancelled
+// half way.
+func (s *Service) Start(ctx context.Context) {
+	run := func(fn job) {
+		if err := fn(context.Background()); err != nil {
+			log.Println(err)
+		}
+	}
+
+	for {
+		select {
+		case fn := <-s.jobs:
+			run(fn)
+		case <-ctx.Done():
+			for {
+				select {
+				case fn := <-s.jobs:
+					run(fn)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// StartTrimmer trims every timeline every interval until ctx is done.
+func (s *Service) StartTrimmer(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Trim(ctx); err != nil && ctx.Err() == nil {
+				log.Println(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/me0888/twitter/pkg/models"
+)
+
+// Scopes granted to a session. Sessions opened with a password get both.
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+)
+
+// Roles a user can hold. Every user has RoleUser.
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// lastSeenInterval is how stale the last_seen of a session may get before a
+// request records it again, so that not every request writes.
+const lastSeenInterval = time.Minute
+
+// Authenticate resolves an access token to the principal it acts for and
+// records the session as seen. A session revoked meanwhile is rejected like
+// an unknown token.
+func (s *Service) Authenticate(ctx context.Context, token string) (models.Principal, error) {
+	var principal models.Principal
+	var stale bool
+
+	sessionID, userID, err := s.sessionByToken(ctx, token)
+	if err != nil {
+		return principal, err
+	}
+
+	err = s.pool.QueryRow(ctx, `
+	SELECT users_tokens.scopes, users.roles, users.locale, users_tokens.last_seen < now() - $2 * interval '1 second'
+	FROM users_tokens JOIN users ON users.id = users_tokens.user_id
+	WHERE users_tokens.id = $1`, sessionID, lastSeenInterval.Seconds()).
+		Scan(&principal.Scopes, &principal.Roles, &principal.Locale, &stale)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return principal, ErrInvalidToken
+	}
+	if err != nil {
+		return principal, fmt.Errorf("Error query select token: %w", err)
+	}
+
+	if stale {
+		_, err = s.pool.Exec(ctx, `
+		UPDATE users_tokens SET last_seen = now() WHERE id = $1 AND last_seen < now() - $2 * interval '1 second'`,
+			sessionID, lastSeenInterval.Seconds())
+		if err != nil {
+			return principal, fmt.Errorf("Error update token last seen: %w", err)
+		}
+	}
+
+	principal.UserID = userID
+	principal.SessionID = sessionID
+	return principal, nil
+}
@@ -2,55 +2,173 @@ package users
 
 import (
 	"context"
-	"crypto/rand"
-	"encoding/hex"
 	"errors"
 	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/me0888/twitter/pkg/apperr"
+	"github.com/me0888/twitter/pkg/mail"
 	"github.com/me0888/twitter/pkg/models"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/me0888/twitter/pkg/pagination"
+	"github.com/me0888/twitter/pkg/timeline"
 )
 
-var ErrForbiddenFollow = errors.New("you can not follow yourself")
-var ErrInvalidPassword = errors.New("invalid password")
-var ErrInternal = errors.New("internal error")
+var ErrForbiddenFollow = apperr.New(http.StatusBadRequest, "cannot_follow_self", "you can not follow yourself")
+var ErrInvalidPassword = apperr.New(http.StatusUnauthorized, "invalid_credentials", "invalid password")
+var ErrInternal = apperr.New(http.StatusInternalServerError, "internal", "internal error")
+var ErrInvalidToken = apperr.New(http.StatusUnauthorized, "unauthorized", "invalid or expired token")
+var ErrSessionNotFound = apperr.New(http.StatusNotFound, "session_not_found", "session not found")
+var ErrUserNotFound = apperr.New(http.StatusNotFound, "user_not_found", "user not found")
+var ErrEmailTaken = apperr.New(http.StatusConflict, "email_taken", "email is already taken")
+var ErrUsernameTaken = apperr.New(http.StatusConflict, "username_taken", "username is already taken")
+var ErrRefreshTokenReused = apperr.New(http.StatusUnauthorized, "refresh_token_reused", "refresh token reused, session revoked")
+
+// Users are listed by username.
+var userKeys = pagination.Keyset{Key: "users.username", ID: "users.id", Type: "text"}
 
 type Service struct {
-	pool *pgxpool.Pool
+	pool       *pgxpool.Pool
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+	mailer     mail.Mailer
+	secret     []byte
+	hasher     PasswordHasher
+	dummyHash  string
+	validator  *Validator
+	timeline   *timeline.Service
 }
 
 func NewService(pool *pgxpool.Pool) *Service {
-	return &Service{pool: pool}
+	s := &Service{pool: pool, accessTTL: DefaultAccessTTL, refreshTTL: DefaultRefreshTTL, mailer: mail.NewLogMailer(), validator: NewValidator()}
+	s.SetPasswordHasher(NewArgon2Hasher(DefaultArgon2Params))
+	return s
+}
+
+// SetValidator replaces the validator applied by Save and Update.
+func (s *Service) SetValidator(validator *Validator) {
+	s.validator = validator
+}
+
+// SetTimeline makes follows and unfollows update the home timelines kept
+// by t.
+func (s *Service) SetTimeline(t *timeline.Service) {
+	s.timeline = t
+}
+
+// SetPasswordHasher replaces the hasher used for new and upgraded passwords.
+func (s *Service) SetPasswordHasher(hasher PasswordHasher) {
+	s.hasher = hasher
+	// Verified against when the email is unknown, so that a failed login
+	// costs the same whether or not the account exists.
+	s.dummyHash, _ = hasher.Hash("dummy password")
 }
 
 func (s *Service) Save(ctx context.Context, item *models.UserInput) (*models.User_resp, error) {
 	var resp models.User_resp
-	var err error
+
+	if err := s.validator.User(item, false); err != nil {
+		return nil, err
+	}
+
+	hash, err := s.hasher.Hash(item.Password)
+	if err != nil {
+		return nil, err
+	}
+
 	err = s.pool.QueryRow(ctx, `INSERT INTO users (email, username, password) VALUES ($1, $2, $3) 
-	RETURNING email, username;
-		`, item.Email, item.Username, item.Password).
-		Scan(&resp.Email, &resp.Username)
+	RETURNING id, email, username;
+		`, item.Email, item.Username, hash).
+		Scan(&resp.ID, &resp.Email, &resp.Username)
 
 	if err != nil {
-		return nil, fmt.Errorf("Error insert user: %v", err)
+		return nil, fmt.Errorf("Error insert user: %w", takenError(err))
 	}
 
 	return &resp, nil
 }
 
-func (s *Service) Update(ctx context.Context, item *models.UserInput, id int64) (*models.User_resp, error) {
-	var resp models.User_resp
-	var err error
-	err = s.pool.QueryRow(ctx, `UPDATE users SET email=$1, username=$2, password=$3 WHERE id=$4 
-	RETURNING email, username;
-		`, item.Email, item.Username, item.Password, id).
-		Scan(&resp.Email, &resp.Username)
+// Update applies patch to the profile of user id. Only the fields set in
+// patch are changed, and only the values that differ from the stored ones
+// are validated, so that a name taken under older rules does not block
+// other edits. Changing the email or the password requires the current
+// password.
+func (s *Service) Update(ctx context.Context, id int64, patch models.UserPatch) (models.UserProfile, error) {
+	var item models.UserInput
+	var hash string
 
+	var locale string
+
+	err := s.pool.QueryRow(ctx, `SELECT email, username, password, locale FROM users WHERE id = $1`, id).
+		Scan(&item.Email, &item.Username, &hash, &locale)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.UserProfile{}, ErrUserNotFound
+	}
 	if err != nil {
-		return nil, fmt.Errorf("Error update user: %v", err)
+		return models.UserProfile{}, fmt.Errorf("Error query select user: %w", err)
+	}
+	errs := apperr.FieldErrors{}
+	emailChanged := false
+	if patch.Email != nil {
+		email := strings.ToLower(strings.TrimSpace(*patch.Email))
+		if emailChanged = !strings.EqualFold(email, item.Email); emailChanged {
+			item.Email = email
+			if reason := s.validator.Email(email); reason != "" {
+				errs["email"] = reason
+			}
+		}
+	}
+	if patch.Username != nil && *patch.Username != item.Username {
+		item.Username = *patch.Username
+		if reason := s.validator.Username(item.Username); reason != "" {
+			errs["username"] = reason
+		}
+	}
+	if patch.Password != nil {
+		item.Password = *patch.Password
+		if reason := s.validator.Password(item.Password); reason != "" {
+			errs["password"] = reason
+		}
+	}
+	if patch.Locale != nil {
+		locale = *patch.Locale
+		if reason := s.validator.Locale(locale); reason != "" {
+			errs["locale"] = reason
+		}
+	}
+	if len(errs) > 0 {
+		return models.UserProfile{}, errs
 	}
 
-	return &resp, nil
+	if emailChanged || item.Password != "" {
+		if patch.CurrentPassword == "" {
+			return models.UserProfile{}, apperr.FieldErrors{"current_password": "current_password_required"}
+		}
+		ok, _, err := s.hasher.Verify(hash, patch.CurrentPassword)
+		if err != nil || !ok {
+			return models.UserProfile{}, ErrInvalidPassword
+		}
+	}
+
+	password := hash
+	if item.Password != "" {
+		password, err = s.hasher.Hash(item.Password)
+		if err != nil {
+			return models.UserProfile{}, err
+		}
+	}
+
+	_, err = s.pool.Exec(ctx, `UPDATE users SET email=$1, username=$2, password=$3, locale=$5, email_verified = email_verified AND lower(email) = lower($1) WHERE id=$4`,
+		item.Email, item.Username, password, id, locale)
+	if err != nil {
+		return models.UserProfile{}, fmt.Errorf("Error update user: %w", takenError(err))
+	}
+
+	return s.User(ctx, id)
 }
 
 func (s *Service) UpdateAvatar(ctx context.Context, avatar string, id int64) (string, error) {
@@ -62,7 +180,7 @@ func (s *Service) UpdateAvatar(ctx context.Context, avatar string, id int64) (st
 		Scan(&resp.Avatar)
 
 	if err != nil {
-		return "", fmt.Errorf("Error update avatar: %v", err)
+		return "", fmt.Errorf("Error update avatar: %w", err)
 	}
 
 	return resp.Avatar, nil
@@ -74,77 +192,123 @@ func (s *Service) GetAvatar(ctx context.Context, id int64) (string, error) {
 		`, id).
 		Scan(&avatar)
 	if err != nil {
-		return "", fmt.Errorf("Error query select avatar: %v", err)
+		return "", fmt.Errorf("Error query select avatar: %w", err)
+	}
+
+	return avatar, nil
+}
+
+// UserAvatar returns the stored avatar path of username, "" when they have
+// not uploaded one.
+func (s *Service) UserAvatar(ctx context.Context, username string) (string, error) {
+	var avatar string
+	err := s.pool.QueryRow(ctx, `SELECT COALESCE(avatar, '') FROM users WHERE username = $1`, username).Scan(&avatar)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrUserNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("Error query select avatar: %w", err)
 	}
 
 	return avatar, nil
 }
 
+// Follow toggles whether followerID follows username.
 func (s *Service) Follow(ctx context.Context, followerID int64, username string) (models.FollowResponse, error) {
+	return s.setFollow(ctx, followerID, username, nil)
+}
+
+// SetFollow follows or unfollows username. Repeating the call changes
+// nothing, so clients can retry it safely.
+func (s *Service) SetFollow(ctx context.Context, followerID int64, username string, following bool) (models.FollowResponse, error) {
+	return s.setFollow(ctx, followerID, username, &following)
+}
+
+// setFollow brings the follow to the wanted state, or flips it when wanted
+// is nil, in one transaction. Both user rows are locked in id order so that
+// two users following each other at once cannot deadlock.
+func (s *Service) setFollow(ctx context.Context, followerID int64, username string, wanted *bool) (models.FollowResponse, error) {
 	var response models.FollowResponse
 	var followeeID int64
 	err := s.pool.QueryRow(ctx, `SELECT id FROM users where username = $1;
 		`, username).Scan(&followeeID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return response, ErrUserNotFound
+	}
 	if err != nil {
-		return response, fmt.Errorf("Error query select: %v", err)
+		return response, fmt.Errorf("Error query select: %w", err)
 	}
 
 	if followeeID == followerID {
 		return response, ErrForbiddenFollow
 	}
 
-	err = s.pool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM follows WHERE follower_id = $1 AND followee_id = $2);
-		`, followerID, followeeID).Scan(&response.Following)
+	tx, err := s.pool.Begin(ctx)
 	if err != nil {
-		return response, fmt.Errorf("Error query select: %v", err)
+		return response, fmt.Errorf("Error begin follow: %w", err)
 	}
+	defer tx.Rollback(ctx)
 
-	if response.Following {
-		_, err = s.pool.Exec(ctx, `DELETE FROM follows WHERE follower_id = $1 AND followee_id = $2;`, followerID, followeeID)
-		if err != nil {
-			return response, fmt.Errorf("Error delete follow : %v", err)
-		}
+	if _, err = tx.Exec(ctx, `SELECT id FROM users WHERE id IN ($1, $2) ORDER BY id FOR UPDATE`, followerID, followeeID); err != nil {
+		return response, fmt.Errorf("Error lock users: %w", err)
+	}
 
-		_, err = s.pool.Exec(ctx, `UPDATE users SET followees_count = followees_count - 1 WHERE id = $1`, followerID)
-		if err != nil {
-			return response, fmt.Errorf("Error update followees count : %v", err)
-		}
+	err = tx.QueryRow(ctx, `SELECT followers_count, EXISTS (SELECT 1 FROM follows WHERE follower_id = $1 AND followee_id = $2)
+		FROM users WHERE id = $2`, followerID, followeeID).Scan(&response.FollowersCount, &response.Following)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return response, ErrUserNotFound
+	}
+	if err != nil {
+		return response, fmt.Errorf("Error query select: %w", err)
+	}
 
-		err = s.pool.QueryRow(ctx, `UPDATE users SET followers_count = followers_count - 1 WHERE id = $1 RETURNING followers_count`, followeeID).Scan(&response.FollowersCount)
-		if err != nil {
-			return response, fmt.Errorf("Error update followers count : %v", err)
-		}
-	} else {
-		_, err = s.pool.Exec(ctx, `INSERT INTO follows (follower_id, followee_id) VALUES ($1, $2);`, followerID, followeeID)
-		if err != nil {
-			return response, fmt.Errorf("Error insert follow: %v", err)
-		}
+	following := !response.Following
+	if wanted != nil {
+		following = *wanted
+	}
+	if following == response.Following {
+		return response, nil
+	}
 
-		_, err = s.pool.Exec(ctx, `UPDATE users SET followees_count = followees_count + 1 where id = $1`, followerID)
-		if err != nil {
-			return response, fmt.Errorf("Error update follower followees count: %v", err)
-		}
+	query, delta := `INSERT INTO follows (follower_id, followee_id) VALUES ($1, $2);`, 1
+	if !following {
+		query, delta = `DELETE FROM follows WHERE follower_id = $1 AND followee_id = $2;`, -1
+	}
+	if _, err = tx.Exec(ctx, query, followerID, followeeID); err != nil {
+		return response, fmt.Errorf("Error update follow: %w", err)
+	}
 
-		err = s.pool.QueryRow(ctx, `UPDATE users SET followers_count = followers_count + 1 where id = $1 RETURNING followers_count`, followeeID).Scan(&response.FollowersCount)
-		if err != nil {
-			return response, fmt.Errorf("Error update followee followers count: %v", err)
-		}
+	_, err = tx.Exec(ctx, `UPDATE users SET followees_count = followees_count + $2 WHERE id = $1`, followerID, delta)
+	if err != nil {
+		return response, fmt.Errorf("Error update followees count : %w", err)
+	}
+
+	err = tx.QueryRow(ctx, `UPDATE users SET followers_count = followers_count + $2 WHERE id = $1 RETURNING followers_count`, followeeID, delta).Scan(&response.FollowersCount)
+	if err != nil {
+		return response, fmt.Errorf("Error update followers count : %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return response, fmt.Errorf("Error commit follow: %w", err)
+	}
 
+	if s.timeline != nil {
+		s.timeline.Followed(followerID, followeeID, following)
 	}
-	response.Following = !response.Following
+
+	response.Following = following
 	return response, nil
 }
 
-func (s *Service) Users(ctx context.Context, search string) ([]models.UserProfile, error) {
-
+func (s *Service) Users(ctx context.Context, search string, page pagination.Query) (pagination.Page, error) {
+	where, tail, args := userKeys.Clause(page, 2)
 	rows, err := s.pool.Query(ctx, `
 		SELECT id, email, username, followers_count, followees_count
 		FROM users
 		WHERE username ILIKE '%'|| $1 ||'%'
-		ORDER BY username ASC
-		`, search)
+		AND `+where+` `+tail, append([]interface{}{search}, args...)...)
 	if err != nil {
-		return nil, fmt.Errorf("Error query select: %v", err)
+		return pagination.Page{}, fmt.Errorf("Error query select: %w", err)
 	}
 
 	defer rows.Close()
@@ -153,43 +317,48 @@ func (s *Service) Users(ctx context.Context, search string) ([]models.UserProfil
 		var u models.UserProfile
 
 		if err = rows.Scan(&u.ID, &u.Email, &u.UserName, &u.FollowersCount, &u.FolloweesCount); err != nil {
-			return nil, fmt.Errorf("Error scan user: %v", err)
+			return pagination.Page{}, fmt.Errorf("Error scan user: %w", err)
 		}
 
 		uu = append(uu, u)
 	}
 	if err = rows.Err(); err != nil {
-		return nil, fmt.Errorf("Error iterate user rows: %v", err)
+		return pagination.Page{}, fmt.Errorf("Error iterate user rows: %w", err)
 	}
-	return uu, nil
+	return page.Page(uu, func(i int) pagination.Cursor {
+		return pagination.Cursor{Key: uu[i].UserName, ID: uu[i].ID}
+	}), nil
 }
 
 func (s *Service) User(ctx context.Context, id int64) (models.UserProfile, error) {
 	var u models.UserProfile
 	err := s.pool.QueryRow(ctx, `
-		SELECT id, email, username, avatar, followers_count, followees_count 
+		SELECT id, email, username, avatar, locale, followers_count, followees_count 
 		FROM users
 		WHERE id=$1 
 		ORDER BY username ASC
 		`, id).
-		Scan(&u.ID, &u.Email, &u.UserName, &u.Avatar, &u.FollowersCount, &u.FolloweesCount)
+		Scan(&u.ID, &u.Email, &u.UserName, &u.Avatar, &u.Locale, &u.FollowersCount, &u.FolloweesCount)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return u, ErrUserNotFound
+	}
 	if err != nil {
-		return u, fmt.Errorf("Error query select: %v", err)
+		return u, fmt.Errorf("Error query select: %w", err)
 	}
 
 	return u, nil
 }
 
-func (s *Service) Followers(ctx context.Context, username string) ([]models.UserProfile, error) {
+func (s *Service) Followers(ctx context.Context, username string, page pagination.Query) (pagination.Page, error) {
+	where, tail, args := userKeys.Clause(page, 2)
 	rows, err := s.pool.Query(ctx, `
 		SELECT id, email, username, followers_count, followees_count
 		FROM follows, users
 		WHERE follows.followee_id = (SELECT id FROM users WHERE username = $1) 
 		AND users.id=follows.follower_id
-		ORDER BY username ASC
-		`, username)
+		AND `+where+` `+tail, append([]interface{}{username}, args...)...)
 	if err != nil {
-		return nil, fmt.Errorf("Error query select: %v", err)
+		return pagination.Page{}, fmt.Errorf("Error query select: %w", err)
 	}
 	defer rows.Close()
 	uu := make([]models.UserProfile, 0)
@@ -197,27 +366,29 @@ func (s *Service) Followers(ctx context.Context, username string) ([]models.User
 		var u models.UserProfile
 
 		if err = rows.Scan(&u.ID, &u.Email, &u.UserName, &u.FollowersCount, &u.FolloweesCount); err != nil {
-			return nil, fmt.Errorf("Error scan user: %v", err)
+			return pagination.Page{}, fmt.Errorf("Error scan user: %w", err)
 		}
 
 		uu = append(uu, u)
 	}
 	if err = rows.Err(); err != nil {
-		return nil, fmt.Errorf("Error iterate user rows: %v", err)
+		return pagination.Page{}, fmt.Errorf("Error iterate user rows: %w", err)
 	}
-	return uu, nil
+	return page.Page(uu, func(i int) pagination.Cursor {
+		return pagination.Cursor{Key: uu[i].UserName, ID: uu[i].ID}
+	}), nil
 }
 
-func (s *Service) Followees(ctx context.Context, username string) ([]models.UserProfile, error) {
+func (s *Service) Followees(ctx context.Context, username string, page pagination.Query) (pagination.Page, error) {
+	where, tail, args := userKeys.Clause(page, 2)
 	rows, err := s.pool.Query(ctx, `
 		SELECT id, email, username, followers_count, followees_count
 		FROM follows, users
 		WHERE follows.follower_id = (SELECT id FROM users WHERE username = $1) 
 		AND users.id=follows.followee_id
-		ORDER BY username ASC
-		`, username)
+		AND `+where+` `+tail, append([]interface{}{username}, args...)...)
 	if err != nil {
-		return nil, fmt.Errorf("Error query select : %v", err)
+		return pagination.Page{}, fmt.Errorf("Error query select : %w", err)
 	}
 	defer rows.Close()
 
@@ -225,56 +396,192 @@ func (s *Service) Followees(ctx context.Context, username string) ([]models.User
 	for rows.Next() {
 		var u models.UserProfile
 		if err = rows.Scan(&u.ID, &u.Email, &u.UserName, &u.FollowersCount, &u.FolloweesCount); err != nil {
-			return nil, fmt.Errorf("Error scan user: %v", err)
+			return pagination.Page{}, fmt.Errorf("Error scan user: %w", err)
 		}
 
 		uu = append(uu, u)
 	}
 	if err = rows.Err(); err != nil {
-		return nil, fmt.Errorf("Error iterate user rows: %v", err)
+		return pagination.Page{}, fmt.Errorf("Error iterate user rows: %w", err)
 	}
-	return uu, nil
+	return page.Page(uu, func(i int) pagination.Cursor {
+		return pagination.Cursor{Key: uu[i].UserName, ID: uu[i].ID}
+	}), nil
 }
 
-func (s *Service) Token(ctx context.Context, email string, password string) (token string, err error) {
+func (s *Service) Token(ctx context.Context, email string, password string, userAgent string) (models.LoginOutput, error) {
+	var output models.LoginOutput
 	var hash string
 	var id int64
+	var totpEnabled bool
+
+	err := s.pool.QueryRow(ctx, `SELECT id, password, totp_enabled FROM users WHERE lower(email) = lower($1)`, email).Scan(&id, &hash, &totpEnabled)
+	if errors.Is(err, pgx.ErrNoRows) {
+		s.hasher.Verify(s.dummyHash, password)
+		return output, ErrInvalidPassword
+	}
+	if err != nil {
+		return output, fmt.Errorf("Error query select : %w", err)
+	}
+
+	ok, rehash, err := s.hasher.Verify(hash, password)
+	if err != nil || !ok {
+		return output, ErrInvalidPassword
+	}
+
+	if rehash {
+		if err = s.rehash(ctx, id, hash, password); err != nil {
+			log.Println(err)
+		}
+	}
+
+	if totpEnabled {
+		return s.issueChallenge(ctx, id)
+	}
+
+	return s.issueTokens(ctx, id, userAgent)
+}
+
+// takenError converts a unique violation on the users table into the
+// sentinel naming the field that is already taken.
+func takenError(err error) error {
+	constraint, ok := apperr.UniqueViolation(err)
+	if !ok {
+		return err
+	}
+
+	if strings.Contains(constraint, "email") {
+		return ErrEmailTaken
+	}
+	if strings.Contains(constraint, "username") {
+		return ErrUsernameTaken
+	}
+	return err
+}
 
-	err = s.pool.QueryRow(ctx, `SELECT id, password FROM users WHERE email =$1`, email).Scan(&id, &hash)
+// rehash replaces oldHash with a hash made by the current hasher, unless the
+// password was changed concurrently.
+func (s *Service) rehash(ctx context.Context, id int64, oldHash string, password string) error {
+	hash, err := s.hasher.Hash(password)
 	if err != nil {
-		return "", fmt.Errorf("Error query select : %v", err)
+		return err
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	_, err = s.pool.Exec(ctx, `UPDATE users SET password = $2 WHERE id = $1 AND password = $3`, id, hash, oldHash)
 	if err != nil {
-		return "", ErrInvalidPassword
+		return fmt.Errorf("Error update password hash: %w", err)
 	}
 
-	buffer := make([]byte, 256)
-	n, err := rand.Read(buffer)
-	if n != len(buffer) || err != nil {
-		return "", ErrInternal
+	return nil
+}
+
+func (s *Service) Logout(ctx context.Context, sessionID int64) error {
+	_, err := s.pool.Exec(ctx, `DELETE FROM users_tokens WHERE id = $1`, sessionID)
+	if err != nil {
+		return fmt.Errorf("Error delete users token: %w", err)
 	}
 
-	token = hex.EncodeToString(buffer)
-	_, err = s.pool.Exec(ctx, `INSERT INTO users_tokens (token, user_id) VALUES ($1, $2)`, token, id)
+	return nil
+}
 
+func (s *Service) Sessions(ctx context.Context, userID int64, currentID int64) ([]models.Session, error) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT t.id, t.created, GREATEST(t.expire, MAX(r.expire)), t.last_seen, t.user_agent, t.id = $2
+		FROM users_tokens t
+		LEFT JOIN users_refresh_tokens r ON r.session_id = t.id AND r.used_at IS NULL
+		WHERE t.user_id = $1
+		GROUP BY t.id
+		HAVING GREATEST(t.expire, MAX(r.expire)) > now()
+		ORDER BY t.last_seen DESC
+		`, userID, currentID)
 	if err != nil {
-		return "", fmt.Errorf("Error query insert users tokens : %v", err)
+		return nil, fmt.Errorf("Error query select sessions: %w", err)
 	}
+	defer rows.Close()
 
-	return token, nil
+	ss := make([]models.Session, 0)
+	for rows.Next() {
+		var session models.Session
+		if err = rows.Scan(&session.ID, &session.Created, &session.Expire, &session.LastSeen, &session.UserAgent, &session.Current); err != nil {
+			return nil, fmt.Errorf("Error scan session: %w", err)
+		}
+		ss = append(ss, session)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error iterate session rows: %w", err)
+	}
+	return ss, nil
 }
 
-func (s *Service) IDByToken(ctx context.Context, token string) (id int64, err error) {
-	var expire bool
-	err = s.pool.QueryRow(ctx, `
-	SELECT user_id, now()>expire as expire FROM users_tokens WHERE token =$1;`,
-		token).Scan(&id, &expire)
+func (s *Service) RevokeSession(ctx context.Context, userID int64, sessionID int64) error {
+	tag, err := s.pool.Exec(ctx, `DELETE FROM users_tokens WHERE id = $1 AND user_id = $2`, sessionID, userID)
+	if err != nil {
+		return fmt.Errorf("Error delete session: %w", err)
+	}
 
+	if tag.RowsAffected() == 0 {
+		return ErrSessionNotFound
+	}
+
+	return nil
+}
+
+func (s *Service) RevokeSessions(ctx context.Context, userID int64) (int64, error) {
+	tag, err := s.pool.Exec(ctx, `DELETE FROM users_tokens WHERE user_id = $1`, userID)
 	if err != nil {
-		return 0, fmt.Errorf("Error query select token: %v", err)
+		return 0, fmt.Errorf("Error delete sessions: %w", err)
 	}
 
-	return id, nil
+	return tag.RowsAffected(), nil
+}
+
+// SweepTokens deletes expired refresh tokens, login challenges and action
+// tokens, and every session whose access token has expired and which can no
+// longer be refreshed.
+func (s *Service) SweepTokens(ctx context.Context) (int64, error) {
+	_, err := s.pool.Exec(ctx, `DELETE FROM users_refresh_tokens WHERE expire <= now()`)
+	if err != nil {
+		return 0, fmt.Errorf("Error delete expired refresh tokens: %w", err)
+	}
+
+	_, err = s.pool.Exec(ctx, `DELETE FROM users_login_challenges WHERE expire <= now()`)
+	if err != nil {
+		return 0, fmt.Errorf("Error delete expired login challenges: %w", err)
+	}
+
+	_, err = s.pool.Exec(ctx, `DELETE FROM users_action_tokens WHERE expire <= now()`)
+	if err != nil {
+		return 0, fmt.Errorf("Error delete expired action tokens: %w", err)
+	}
+
+	tag, err := s.pool.Exec(ctx, `
+	DELETE FROM users_tokens t WHERE t.expire <= now() AND NOT EXISTS (
+		SELECT 1 FROM users_refresh_tokens r WHERE r.session_id = t.id AND r.used_at IS NULL)`)
+	if err != nil {
+		return 0, fmt.Errorf("Error delete expired tokens: %w", err)
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+// StartTokenSweeper runs SweepTokens every interval until ctx is cancelled.
+func (s *Service) StartTokenSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := s.SweepTokens(ctx)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			if n > 0 {
+				log.Printf("Token sweeper removed %d expired tokens", n)
+			}
+		}
+	}
 }
@@ -0,0 +1,208 @@
+package users
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/me0888/twitter/pkg/models"
+)
+
+// DefaultAccessTTL is how long a bearer token issued by Token or Refresh is valid.
+const DefaultAccessTTL = 15 * time.Minute
+
+// DefaultRefreshTTL is how long a refresh token may be exchanged for a new pair.
+const DefaultRefreshTTL = 30 * 24 * time.Hour
+
+// SetTokenTTL overrides the default access and refresh token lifetimes.
+func (s *Service) SetTokenTTL(access, refresh time.Duration) {
+	s.accessTTL = access
+	s.refreshTTL = refresh
+}
+
+// Refresh exchanges a refresh token for a new access and refresh token of the
+// same session. Every refresh token can be used once: presenting one that was
+// already rotated revokes the whole session it belongs to.
+func (s *Service) Refresh(ctx context.Context, refreshToken string, userAgent string) (models.LoginOutput, error) {
+	var output models.LoginOutput
+	var refreshID, sessionID int64
+	var used, expired bool
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return output, fmt.Errorf("Error begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.QueryRow(ctx, `
+	SELECT id, session_id, used_at IS NOT NULL, expire <= now() FROM users_refresh_tokens WHERE token = $1 FOR UPDATE`,
+		hashToken(refreshToken)).Scan(&refreshID, &sessionID, &used, &expired)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return output, ErrInvalidToken
+	}
+	if err != nil {
+		return output, fmt.Errorf("Error query select refresh token: %w", err)
+	}
+
+	if used {
+		if _, err = tx.Exec(ctx, `DELETE FROM users_tokens WHERE id = $1`, sessionID); err != nil {
+			return output, fmt.Errorf("Error delete session: %w", err)
+		}
+		if err = tx.Commit(ctx); err != nil {
+			return output, fmt.Errorf("Error commit transaction: %w", err)
+		}
+		return output, ErrRefreshTokenReused
+	}
+
+	if expired {
+		return output, ErrInvalidToken
+	}
+
+	if _, err = tx.Exec(ctx, `UPDATE users_refresh_tokens SET used_at = now() WHERE id = $1`, refreshID); err != nil {
+		return output, fmt.Errorf("Error update refresh token: %w", err)
+	}
+
+	output.Token, err = newToken(256)
+	if err != nil {
+		return output, err
+	}
+
+	err = tx.QueryRow(ctx, `
+	UPDATE users_tokens SET token_prefix = $2, token_hash = $3, expire = now() + $4 * interval '1 second', last_seen = now(), user_agent = $5
+	WHERE id = $1 RETURNING expire`,
+		sessionID, tokenPrefix(output.Token), hashToken(output.Token), s.accessTTL.Seconds(), userAgent).Scan(&output.ExpiresAt)
+	if err != nil {
+		return output, fmt.Errorf("Error update users token: %w", err)
+	}
+
+	output.RefreshToken, err = s.insertRefreshToken(ctx, tx, sessionID)
+	if err != nil {
+		return output, err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return output, fmt.Errorf("Error commit transaction: %w", err)
+	}
+
+	return output, nil
+}
+
+// issueTokens opens a new session for the user and returns its first token pair.
+func (s *Service) issueTokens(ctx context.Context, userID int64, userAgent string) (models.LoginOutput, error) {
+	var output models.LoginOutput
+	var sessionID int64
+
+	token, err := newToken(256)
+	if err != nil {
+		return output, err
+	}
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return output, fmt.Errorf("Error begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.QueryRow(ctx, `
+	INSERT INTO users_tokens (token_prefix, token_hash, user_id, user_agent, expire)
+	VALUES ($1, $2, $3, $4, now() + $5 * interval '1 second')
+	RETURNING id, expire`,
+		tokenPrefix(token), hashToken(token), userID, userAgent, s.accessTTL.Seconds()).Scan(&sessionID, &output.ExpiresAt)
+	if err != nil {
+		return output, fmt.Errorf("Error query insert users tokens : %w", err)
+	}
+
+	output.RefreshToken, err = s.insertRefreshToken(ctx, tx, sessionID)
+	if err != nil {
+		return output, err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return output, fmt.Errorf("Error commit transaction: %w", err)
+	}
+
+	output.Token = token
+	return output, nil
+}
+
+// sessionByToken finds the live session an access token belongs to. Rows are
+// looked up by the token prefix and the stored SHA-256 digest is then compared
+// in constant time, so the raw token never reaches the database.
+func (s *Service) sessionByToken(ctx context.Context, token string) (sessionID int64, userID int64, err error) {
+	if len(token) <= tokenPrefixLen {
+		return 0, 0, ErrInvalidToken
+	}
+
+	rows, err := s.pool.Query(ctx, `
+	SELECT id, user_id, token_hash FROM users_tokens WHERE token_prefix = $1 AND expire > now()`, tokenPrefix(token))
+	if err != nil {
+		return 0, 0, fmt.Errorf("Error query select token: %w", err)
+	}
+	defer rows.Close()
+
+	hash := []byte(hashToken(token))
+	for rows.Next() {
+		var id, user int64
+		var stored string
+		if err = rows.Scan(&id, &user, &stored); err != nil {
+			return 0, 0, fmt.Errorf("Error scan token: %w", err)
+		}
+		if subtle.ConstantTimeCompare(hash, []byte(stored)) == 1 {
+			sessionID, userID = id, user
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return 0, 0, fmt.Errorf("Error iterate token rows: %w", err)
+	}
+
+	if sessionID == 0 {
+		return 0, 0, ErrInvalidToken
+	}
+
+	return sessionID, userID, nil
+}
+
+func (s *Service) insertRefreshToken(ctx context.Context, tx pgx.Tx, sessionID int64) (string, error) {
+	token, err := newToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(ctx, `
+	INSERT INTO users_refresh_tokens (session_id, token, expire) VALUES ($1, $2, now() + $3 * interval '1 second')`,
+		sessionID, hashToken(token), s.refreshTTL.Seconds())
+	if err != nil {
+		return "", fmt.Errorf("Error query insert refresh token: %w", err)
+	}
+
+	return token, nil
+}
+
+func newToken(size int) (string, error) {
+	buffer := make([]byte, size)
+	n, err := rand.Read(buffer)
+	if n != len(buffer) || err != nil {
+		return "", ErrInternal
+	}
+
+	return hex.EncodeToString(buffer), nil
+}
+
+// tokenPrefixLen is the number of leading token characters stored in clear
+// text to index the lookup of a token digest.
+const tokenPrefixLen = 16
+
+func tokenPrefix(token string) string {
+	return token[:tokenPrefixLen]
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
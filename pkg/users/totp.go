@@ -0,0 +1,360 @@
+package users
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/me0888/twitter/pkg/apperr"
+	"github.com/me0888/twitter/pkg/models"
+)
+
+var ErrTOTPEnabled = apperr.New(http.StatusConflict, "two_factor_enabled", "two-factor authentication is already enabled")
+var ErrTOTPNotEnrolled = apperr.New(http.StatusConflict, "two_factor_not_enrolled", "two-factor authentication is not enrolled")
+var ErrInvalidCode = apperr.New(http.StatusUnauthorized, "invalid_two_factor_code", "invalid two-factor code")
+var ErrInvalidChallenge = apperr.New(http.StatusUnauthorized, "invalid_challenge", "invalid or expired login challenge")
+var ErrTooManyAttempts = apperr.New(http.StatusTooManyRequests, "too_many_attempts", "too many attempts, try again later")
+
+// TOTPIssuer is the issuer shown by authenticator apps next to the account.
+const TOTPIssuer = "twitter"
+
+const (
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpSkew          = 1
+	recoveryCodes     = 10
+	challengeTTL      = 5 * time.Minute
+	challengeAttempts = 5
+	disableAttempts   = 5
+	disableWindow     = 15 * time.Minute
+)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// EnrollTOTP generates a new TOTP secret and a fresh set of recovery codes for
+// the user. Two-factor authentication stays off until ConfirmTOTP is called
+// with a code produced from the secret.
+func (s *Service) EnrollTOTP(ctx context.Context, userID int64) (models.TOTPEnrollment, error) {
+	var enrollment models.TOTPEnrollment
+	var email string
+	var enabled bool
+
+	err := s.pool.QueryRow(ctx, `SELECT email, totp_enabled FROM users WHERE id = $1`, userID).Scan(&email, &enabled)
+	if err != nil {
+		return enrollment, fmt.Errorf("Error query select user: %w", err)
+	}
+
+	if enabled {
+		return enrollment, ErrTOTPEnabled
+	}
+
+	secret := make([]byte, 20)
+	if _, err = rand.Read(secret); err != nil {
+		return enrollment, ErrInternal
+	}
+	enrollment.Secret = base32NoPadding.EncodeToString(secret)
+	enrollment.URI = totpURI(enrollment.Secret, email)
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return enrollment, fmt.Errorf("Error begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `UPDATE users SET totp_secret = $2, totp_last_counter = 0 WHERE id = $1`, userID, enrollment.Secret)
+	if err != nil {
+		return enrollment, fmt.Errorf("Error update totp secret: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM users_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return enrollment, fmt.Errorf("Error delete recovery codes: %w", err)
+	}
+
+	enrollment.RecoveryCodes = make([]string, 0, recoveryCodes)
+	for i := 0; i < recoveryCodes; i++ {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return enrollment, err
+		}
+
+		_, err = tx.Exec(ctx, `INSERT INTO users_recovery_codes (user_id, code) VALUES ($1, $2)`, userID, hashToken(code))
+		if err != nil {
+			return enrollment, fmt.Errorf("Error insert recovery code: %w", err)
+		}
+		enrollment.RecoveryCodes = append(enrollment.RecoveryCodes, code)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return enrollment, fmt.Errorf("Error commit transaction: %w", err)
+	}
+
+	return enrollment, nil
+}
+
+// ConfirmTOTP turns two-factor authentication on once the user proves that
+// the authenticator app produces valid codes for the enrolled secret.
+func (s *Service) ConfirmTOTP(ctx context.Context, userID int64, code string) error {
+	var secret string
+	var enabled bool
+
+	err := s.pool.QueryRow(ctx, `SELECT totp_secret, totp_enabled FROM users WHERE id = $1`, userID).Scan(&secret, &enabled)
+	if err != nil {
+		return fmt.Errorf("Error query select user: %w", err)
+	}
+
+	if enabled {
+		return ErrTOTPEnabled
+	}
+	if secret == "" {
+		return ErrTOTPNotEnrolled
+	}
+
+	ok, err := s.checkTOTP(ctx, userID, secret, code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidCode
+	}
+
+	_, err = s.pool.Exec(ctx, `UPDATE users SET totp_enabled = TRUE WHERE id = $1`, userID)
+	if err != nil {
+		return fmt.Errorf("Error update totp enabled: %w", err)
+	}
+
+	return nil
+}
+
+// DisableTOTP turns two-factor authentication off. It requires a current TOTP
+// code or one of the unused recovery codes, and allows disableAttempts tries
+// per disableWindow.
+func (s *Service) DisableTOTP(ctx context.Context, userID int64, code string) error {
+	// The attempt is counted before the code is checked, so that parallel
+	// requests can not all get past the limit.
+	tag, err := s.pool.Exec(ctx, `
+	UPDATE users SET
+		totp_attempts = CASE WHEN totp_attempts_reset <= now() THEN 1 ELSE totp_attempts + 1 END,
+		totp_attempts_reset = CASE WHEN totp_attempts_reset <= now() THEN now() + $3 * interval '1 second' ELSE totp_attempts_reset END
+	WHERE id = $1 AND (totp_attempts_reset <= now() OR totp_attempts < $2)`,
+		userID, disableAttempts, disableWindow.Seconds())
+	if err != nil {
+		return fmt.Errorf("Error update totp attempts: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrTooManyAttempts
+	}
+
+	ok, err := s.checkSecondFactor(ctx, userID, code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidCode
+	}
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("Error begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `
+	UPDATE users SET totp_enabled = FALSE, totp_secret = '', totp_last_counter = 0, totp_attempts = 0 WHERE id = $1`, userID)
+	if err != nil {
+		return fmt.Errorf("Error update totp enabled: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM users_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return fmt.Errorf("Error delete recovery codes: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("Error commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// LoginChallenge exchanges a challenge returned by Token plus a TOTP or
+// recovery code for a token pair.
+func (s *Service) LoginChallenge(ctx context.Context, challenge string, code string, userAgent string) (models.LoginOutput, error) {
+	var output models.LoginOutput
+	var challengeID, userID int64
+
+	// The attempt is claimed before the code is checked, so that parallel
+	// requests can not all get past the limit.
+	err := s.pool.QueryRow(ctx, `
+	UPDATE users_login_challenges SET attempts = attempts + 1
+	WHERE challenge = $1 AND expire > now() AND attempts < $2
+	RETURNING id, user_id`,
+		hashToken(challenge), challengeAttempts).Scan(&challengeID, &userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return output, ErrInvalidChallenge
+	}
+	if err != nil {
+		return output, fmt.Errorf("Error update login challenge: %w", err)
+	}
+
+	ok, err := s.checkSecondFactor(ctx, userID, code)
+	if err != nil {
+		return output, err
+	}
+
+	if !ok {
+		return output, ErrInvalidCode
+	}
+
+	tag, err := s.pool.Exec(ctx, `DELETE FROM users_login_challenges WHERE id = $1`, challengeID)
+	if err != nil {
+		return output, fmt.Errorf("Error delete login challenge: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return output, ErrInvalidChallenge
+	}
+
+	return s.issueTokens(ctx, userID, userAgent)
+}
+
+// issueChallenge stores a short-lived challenge the client has to answer with
+// a second factor before Token hands out a session.
+func (s *Service) issueChallenge(ctx context.Context, userID int64) (models.LoginOutput, error) {
+	var output models.LoginOutput
+
+	challenge, err := newToken(32)
+	if err != nil {
+		return output, err
+	}
+
+	_, err = s.pool.Exec(ctx, `
+	INSERT INTO users_login_challenges (challenge, user_id, expire) VALUES ($1, $2, now() + $3 * interval '1 second')`,
+		hashToken(challenge), userID, challengeTTL.Seconds())
+	if err != nil {
+		return output, fmt.Errorf("Error insert login challenge: %w", err)
+	}
+
+	output.Challenge = challenge
+	return output, nil
+}
+
+// checkSecondFactor accepts either a valid TOTP code or an unused recovery
+// code, which is consumed.
+func (s *Service) checkSecondFactor(ctx context.Context, userID int64, code string) (bool, error) {
+	var secret string
+	var enabled bool
+
+	err := s.pool.QueryRow(ctx, `SELECT totp_secret, totp_enabled FROM users WHERE id = $1`, userID).Scan(&secret, &enabled)
+	if err != nil {
+		return false, fmt.Errorf("Error query select user: %w", err)
+	}
+
+	if !enabled {
+		return false, ErrTOTPNotEnrolled
+	}
+
+	ok, err := s.checkTOTP(ctx, userID, secret, code)
+	if err != nil || ok {
+		return ok, err
+	}
+
+	tag, err := s.pool.Exec(ctx, `
+	UPDATE users_recovery_codes SET used_at = now() WHERE user_id = $1 AND code = $2 AND used_at IS NULL`,
+		userID, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return false, fmt.Errorf("Error update recovery code: %w", err)
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+// checkTOTP validates code against secret and remembers the accepted time
+// step, so one code cannot be replayed within its validity window.
+func (s *Service) checkTOTP(ctx context.Context, userID int64, secret string, code string) (bool, error) {
+	counter, ok := validateTOTP(secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+
+	tag, err := s.pool.Exec(ctx, `
+	UPDATE users SET totp_last_counter = $2 WHERE id = $1 AND totp_last_counter < $2`, userID, int64(counter))
+	if err != nil {
+		return false, fmt.Errorf("Error update totp counter: %w", err)
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+// validateTOTP checks code against the RFC 6238 codes for t and the
+// neighbouring time steps, returning the matching counter.
+func validateTOTP(secret string, code string, t time.Time) (uint64, bool) {
+	key, err := base32NoPadding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := uint64(t.Unix()) / totpPeriod
+	for i := -totpSkew; i <= totpSkew; i++ {
+		counter := current + uint64(i)
+		if subtle.ConstantTimeCompare([]byte(hotp(key, counter)), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+
+	return 0, false
+}
+
+// hotp computes the RFC 4226 one-time password for key and counter.
+func hotp(key []byte, counter uint64) string {
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], counter)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+func totpURI(secret string, email string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", TOTPIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+
+	return "otpauth://totp/" + url.PathEscape(TOTPIssuer+":"+email) + "?" + query.Encode()
+}
+
+func newRecoveryCode() (string, error) {
+	buffer := make([]byte, 5)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", ErrInternal
+	}
+
+	code := strings.ToLower(base32NoPadding.EncodeToString(buffer))
+	return code[:4] + "-" + code[4:], nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	if len(code) != 8 {
+		return code
+	}
+	return code[:4] + "-" + code[4:]
+}
@@ -0,0 +1,156 @@
+package users
+
+import (
+	"bufio"
+	"fmt"
+	"net/mail"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/me0888/twitter/pkg/apperr"
+	"github.com/me0888/twitter/pkg/i18n"
+	"github.com/me0888/twitter/pkg/models"
+)
+
+const (
+	minUsernameLen = 3
+	maxUsernameLen = 30
+	minPasswordLen = 8
+	maxPasswordLen = 128
+)
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// Validator checks and normalises user registration and profile input.
+type Validator struct {
+	denylist map[string]bool
+}
+
+func NewValidator() *Validator {
+	return &Validator{denylist: map[string]bool{}}
+}
+
+// LoadDenylist reads breached passwords from path, one per line. Empty lines
+// and lines starting with # are skipped.
+func (v *Validator) LoadDenylist(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Error open password denylist: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		v.denylist[strings.ToLower(line)] = true
+	}
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("Error read password denylist: %w", err)
+	}
+
+	return nil
+}
+
+// User validates item and lower-cases its email in place. An empty password
+// is accepted when passwordOptional is set, e.g. for a profile update that
+// keeps the old one.
+func (v *Validator) User(item *models.UserInput, passwordOptional bool) error {
+	errs := apperr.FieldErrors{}
+
+	item.Email = strings.ToLower(strings.TrimSpace(item.Email))
+	if reason := v.Email(item.Email); reason != "" {
+		errs["email"] = reason
+	}
+
+	if reason := v.Username(item.Username); reason != "" {
+		errs["username"] = reason
+	}
+
+	if item.Password != "" || !passwordOptional {
+		if reason := v.Password(item.Password); reason != "" {
+			errs["password"] = reason
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Locale returns the reason code why locale is not acceptable as a language
+// preference, or an empty string. An empty locale means no preference.
+func (v *Validator) Locale(locale string) string {
+	if locale != "" && !i18n.Supported(locale) {
+		return "unsupported_locale"
+	}
+
+	return ""
+}
+
+// Email returns the reason code why email is not acceptable, or an empty
+// string. Reason codes are translated under the "field." prefix of the i18n
+// catalogue.
+func (v *Validator) Email(email string) string {
+	if email == "" {
+		return "required"
+	}
+
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email || !strings.Contains(email[strings.LastIndex(email, "@"):], ".") {
+		return "invalid_email"
+	}
+
+	return ""
+}
+
+// Username returns the reason code why username is not acceptable, or an
+// empty string.
+func (v *Validator) Username(username string) string {
+	if username == "" {
+		return "required"
+	}
+
+	if len(username) < minUsernameLen || len(username) > maxUsernameLen {
+		return "username_length"
+	}
+
+	if !usernamePattern.MatchString(username) {
+		return "username_charset"
+	}
+
+	return ""
+}
+
+// Password returns the reason code why password is not acceptable, or an
+// empty string.
+func (v *Validator) Password(password string) string {
+	if password == "" {
+		return "required"
+	}
+
+	length := len([]rune(password))
+	if length < minPasswordLen || length > maxPasswordLen {
+		return "password_length"
+	}
+
+	var letter, digit bool
+	for _, r := range password {
+		letter = letter || unicode.IsLetter(r)
+		digit = digit || unicode.IsDigit(r)
+	}
+	if !letter || !digit {
+		return "password_weak"
+	}
+
+	if v.denylist[strings.ToLower(password)] {
+		return "password_breached"
+	}
+
+	return ""
+}
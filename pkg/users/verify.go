@@ -0,0 +1,261 @@
+package users
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/me0888/twitter/pkg/apperr"
+	"github.com/me0888/twitter/pkg/i18n"
+	"github.com/me0888/twitter/pkg/mail"
+)
+
+var ErrInvalidActionToken = apperr.New(http.StatusBadRequest, "invalid_action_token", "invalid, used or expired token")
+var ErrEmailNotVerified = apperr.New(http.StatusForbidden, "email_not_verified", "email is not verified")
+var ErrEmailVerified = apperr.New(http.StatusConflict, "email_already_verified", "email is already verified")
+
+const (
+	purposeResetPassword = "reset"
+	purposeVerifyEmail   = "verify"
+	resetPasswordTTL     = time.Hour
+	verifyEmailTTL       = 48 * time.Hour
+)
+
+// actionClaims is the signed payload of a password reset or email
+// verification token. Nonce is recorded in users_action_tokens so that the
+// token can be used only once.
+type actionClaims struct {
+	Purpose string `json:"p"`
+	UserID  int64  `json:"u"`
+	Email   string `json:"m"`
+	Expire  int64  `json:"e"`
+	Nonce   string `json:"n"`
+}
+
+// SetMailer sets the Mailer used to deliver reset and verification tokens.
+func (s *Service) SetMailer(mailer mail.Mailer) {
+	s.mailer = mailer
+}
+
+// SetSecret sets the key used to sign reset and verification tokens.
+func (s *Service) SetSecret(secret []byte) {
+	s.secret = secret
+}
+
+// RequestPasswordReset mails a password reset token to the account whose
+// email matches email in any case, at the address stored for it. Unknown
+// addresses are ignored so callers cannot probe which accounts exist; the
+// token and mail are still built for them, so that the response time does
+// not tell them apart either. The mail is written in the user's preferred
+// language, or in lang if they have not chosen one.
+func (s *Service) RequestPasswordReset(ctx context.Context, email string, lang string) error {
+	var id int64
+	var stored, locale string
+
+	err := s.pool.QueryRow(ctx, `SELECT id, email, locale FROM users WHERE lower(email) = lower($1)`, email).Scan(&id, &stored, &locale)
+	if errors.Is(err, pgx.ErrNoRows) {
+		_, token, err := s.signAction(purposeResetPassword, 0, email, resetPasswordTTL)
+		if err != nil {
+			return err
+		}
+		_ = resetMessage(lang, email, token)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error query select user: %w", err)
+	}
+
+	token, err := s.actionToken(ctx, purposeResetPassword, id, stored, resetPasswordTTL)
+	if err != nil {
+		return err
+	}
+
+	if locale != "" {
+		lang = locale
+	}
+
+	return s.mailer.Send(ctx, resetMessage(lang, stored, token))
+}
+
+func resetMessage(lang string, email string, token string) mail.Message {
+	return mail.Message{
+		To:      email,
+		Subject: i18n.T(lang, "mail.reset.subject"),
+		Body:    i18n.T(lang, "mail.reset.body", token),
+	}
+}
+
+// ResetPassword sets a new password for the owner of a reset token and
+// revokes all of their sessions.
+func (s *Service) ResetPassword(ctx context.Context, token string, password string) error {
+	if reason := s.validator.Password(password); reason != "" {
+		return apperr.FieldErrors{"password": reason}
+	}
+
+	claims, err := s.useActionToken(ctx, purposeResetPassword, token)
+	if err != nil {
+		return err
+	}
+
+	hash, err := s.hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	tag, err := s.pool.Exec(ctx, `UPDATE users SET password = $2 WHERE id = $1 AND email = $3`, claims.UserID, hash, claims.Email)
+	if err != nil {
+		return fmt.Errorf("Error update password: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrInvalidActionToken
+	}
+
+	_, err = s.RevokeSessions(ctx, claims.UserID)
+	return err
+}
+
+// SendVerification mails an email verification token to the user, in their
+// preferred language or in lang if they have not chosen one.
+func (s *Service) SendVerification(ctx context.Context, userID int64, lang string) error {
+	var email, locale string
+	var verified bool
+
+	err := s.pool.QueryRow(ctx, `SELECT email, email_verified, locale FROM users WHERE id = $1`, userID).Scan(&email, &verified, &locale)
+	if err != nil {
+		return fmt.Errorf("Error query select user: %w", err)
+	}
+
+	if verified {
+		return ErrEmailVerified
+	}
+
+	token, err := s.actionToken(ctx, purposeVerifyEmail, userID, email, verifyEmailTTL)
+	if err != nil {
+		return err
+	}
+
+	if locale != "" {
+		lang = locale
+	}
+
+	return s.mailer.Send(ctx, mail.Message{
+		To:      email,
+		Subject: i18n.T(lang, "mail.verify.subject"),
+		Body:    i18n.T(lang, "mail.verify.body", token),
+	})
+}
+
+// VerifyEmail marks the address a verification token was issued for as
+// verified. A token issued before an email change is rejected.
+func (s *Service) VerifyEmail(ctx context.Context, token string) error {
+	claims, err := s.useActionToken(ctx, purposeVerifyEmail, token)
+	if err != nil {
+		return err
+	}
+
+	tag, err := s.pool.Exec(ctx, `UPDATE users SET email_verified = TRUE WHERE id = $1 AND email = $2`, claims.UserID, claims.Email)
+	if err != nil {
+		return fmt.Errorf("Error update email verified: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrInvalidActionToken
+	}
+
+	return nil
+}
+
+func (s *Service) EmailVerified(ctx context.Context, userID int64) (bool, error) {
+	var verified bool
+
+	err := s.pool.QueryRow(ctx, `SELECT email_verified FROM users WHERE id = $1`, userID).Scan(&verified)
+	if err != nil {
+		return false, fmt.Errorf("Error query select user: %w", err)
+	}
+
+	return verified, nil
+}
+
+// actionToken records a new nonce and returns the signed token carrying it.
+func (s *Service) actionToken(ctx context.Context, purpose string, userID int64, email string, ttl time.Duration) (string, error) {
+	claims, token, err := s.signAction(purpose, userID, email, ttl)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = s.pool.Exec(ctx, `
+	INSERT INTO users_action_tokens (nonce, user_id, purpose, expire) VALUES ($1, $2, $3, now() + $4 * interval '1 second')`,
+		claims.Nonce, userID, purpose, ttl.Seconds())
+	if err != nil {
+		return "", fmt.Errorf("Error insert action token: %w", err)
+	}
+
+	return token, nil
+}
+
+// signAction makes the claims of a new token with a fresh nonce and returns
+// them with the signed token, without recording the nonce.
+func (s *Service) signAction(purpose string, userID int64, email string, ttl time.Duration) (actionClaims, string, error) {
+	nonce, err := newToken(16)
+	if err != nil {
+		return actionClaims{}, "", err
+	}
+
+	claims := actionClaims{Purpose: purpose, UserID: userID, Email: email, Expire: time.Now().Add(ttl).Unix(), Nonce: nonce}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return claims, "", ErrInternal
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return claims, encoded + "." + s.sign(encoded), nil
+}
+
+// useActionToken checks the signature, purpose and expiry of token and marks
+// its nonce as used.
+func (s *Service) useActionToken(ctx context.Context, purpose string, token string) (actionClaims, error) {
+	var claims actionClaims
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(s.sign(parts[0]))) {
+		return claims, ErrInvalidActionToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims, ErrInvalidActionToken
+	}
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return claims, ErrInvalidActionToken
+	}
+
+	if claims.Purpose != purpose || time.Now().Unix() > claims.Expire {
+		return claims, ErrInvalidActionToken
+	}
+
+	tag, err := s.pool.Exec(ctx, `
+	UPDATE users_action_tokens SET used_at = now()
+	WHERE nonce = $1 AND user_id = $2 AND purpose = $3 AND used_at IS NULL AND expire > now()`,
+		claims.Nonce, claims.UserID, claims.Purpose)
+	if err != nil {
+		return claims, fmt.Errorf("Error update action token: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return claims, ErrInvalidActionToken
+	}
+
+	return claims, nil
+}
+
+func (s *Service) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}